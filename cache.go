@@ -0,0 +1,107 @@
+package cors
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheConfig bounds a cache by its number of entries and how long, in seconds, entries stay fresh.
+type cacheConfig struct {
+	Size int   `yaml:"size,omitempty" json:"size,omitempty" toml:"size,omitempty"`
+	TTL  int64 `yaml:"ttl,omitempty" json:"ttl,omitempty" toml:"ttl,omitempty"`
+}
+
+// lru is a least recently used cache whose entries expire after a time to live. It is safe for concurrent use.
+// A nil cache holds nothing.
+type lru struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// Creates a cache from its configuration, falling back to defaultCacheSize and defaultCacheTTL.
+func newLRU(cfg cacheConfig) *lru {
+	size, ttl := cfg.Size, cfg.TTL
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+
+	return &lru{
+		size:    size,
+		ttl:     time.Duration(ttl) * time.Second,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Returns the fresh value cached for the key, if any.
+func (c *lru) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+// Caches the value for the key, evicting the least recently used entry when the cache is full.
+func (c *lru) add(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.entries[key]; ok {
+		e.Value = &lruEntry{key, value, expires}
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value, expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Drops every entry.
+func (c *lru) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
@@ -0,0 +1,48 @@
+// Command corsctl inspects CORS middleware configurations without a running vulcand.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skookum/vulcan-cors"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "corsctl"
+	app.Usage = "inspect CORS middleware configurations"
+	app.Commands = []cli.Command{
+		{
+			Name:   "explain",
+			Usage:  "simulate a browser request and explain the CORS decision",
+			Flags:  cors.ExplainCliFlags(),
+			Action: run(cors.ExplainFromCli),
+		},
+		{
+			Name:   "migrate",
+			Usage:  "rewrite a configuration file in the current versioned schema",
+			Flags:  cors.MigrateCliFlags(),
+			Action: run(cors.MigrateFromCli),
+		},
+		{
+			Name:   "lint",
+			Usage:  "warn about configuration that is valid but probably not intended",
+			Flags:  cors.LintCliFlags(),
+			Action: run(cors.LintFromCli),
+		},
+	}
+
+	app.Run(os.Args)
+}
+
+// Wraps a command so that errors are reported and exit non-zero.
+func run(command func(*cli.Context) error) func(*cli.Context) {
+	return func(c *cli.Context) {
+		if err := command(c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
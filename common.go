@@ -1,34 +1,169 @@
 package cors
 
+import "time"
+
 const (
 	// Response Headers
 	allowOriginHeader  string = "Access-Control-Allow-Origin"
 	allowMethodsHeader string = "Access-Control-Allow-Methods"
 	allowHeadersHeader string = "Access-Control-Allow-Headers"
 	maxAgeHeader       string = "Access-Control-Max-Age"
+	exposeHeader       string = "Access-Control-Expose-Headers"
+	credentialsHeader  string = "Access-Control-Allow-Credentials"
+	timingHeader       string = "Timing-Allow-Origin"
+	allowNetworkHeader string = "Access-Control-Allow-Private-Network"
+
+	// Cross-Origin Isolation Headers
+	resourcePolicyHeader string = "Cross-Origin-Resource-Policy"
+	openerPolicyHeader   string = "Cross-Origin-Opener-Policy"
+	embedderPolicyHeader string = "Cross-Origin-Embedder-Policy"
 
 	// Request Headers
 	requestMethodHeader  string = "Access-Control-Request-Method"
 	requestHeadersHeader string = "Access-Control-Request-Headers"
+	requestNetworkHeader string = "Access-Control-Request-Private-Network"
+
+	// Fetch Metadata Request Headers
+	fetchSiteHeader string = "Sec-Fetch-Site"
+	fetchModeHeader string = "Sec-Fetch-Mode"
+	fetchDestHeader string = "Sec-Fetch-Dest"
 
 	// Common Headers
 	varyHeader   string = "Vary"
 	originHeader string = "Origin"
 
+	// WebSocket Handshake Headers
+	upgradeHeader    string = "Upgrade"
+	connectionHeader string = "Connection"
+	websocketToken   string = "websocket"
+
+	// Headers CSRF protection looks at
+	refererHeader        string = "Referer"
+	forwardedProtoHeader string = "X-Forwarded-Proto"
+
 	// Request Methods
 	optionsMethod string = "OPTIONS"
 
 	// Error Messages
-	errorRoot         string = "request blocked by CORS:"
-	errorBadOrigin    string = "bad host"
-	errorBadMethod    string = "bad method"
-	errorBadHeader    string = "bad header"
-	errorConfigOrigin string = "must supply at least one origin or '*'"
-	errorConfigMethod string = "must supply at least one method or '*'"
-	errorConfigHeader string = "must supply at least one header or '*'"
-	errorFileIO       string = "file error"
+	errorRoot          string = "request blocked by CORS:"
+	errorBadOrigin     string = "bad host"
+	errorBadMethod     string = "bad method"
+	errorBadHeader     string = "bad header"
+	errorHijack        string = "upstream response can't be hijacked"
+	errorBadNetwork    string = "private network access not allowed"
+	errorDeniedOrigin  string = "denied host"
+	errorBlockedOrigin string = "blocked host"
+	errorDelegate      string = "policy service unavailable"
+	errorFetchMetadata string = "cross-site request"
+	errorCSRF          string = "cross-site request forgery"
+	errorWebSocket     string = "websocket not allowed"
+	errorMissingHeader string = "missing required header"
+	errorHeaderValue   string = "bad header value"
+	errorOverride      string = "method override not allowed"
+	errorConfigOrigin  string = "must supply at least one origin or '*'"
+	errorConfigMethod  string = "must supply at least one method or '*'"
+	errorConfigHeader  string = "must supply at least one header or '*'"
+	errorConfigVersion string = "unsupported configuration version"
+	errorConfigMode    string = "mode must be one of strict, enforce or report, got"
+	errorConfigLog     string = "log must be one of denied, all or none, got"
+	errorConfigPattern string = "invalid origin pattern"
+	errorConfigExtend  string = "cannot extend unknown rule"
+	errorConfigPath    string = "invalid path pattern"
+	errorConfigHost    string = "virtual hosts must list hosts, optionally starting with '*.', got"
+	errorConfigCycle   string = "rules extend each other in a cycle at"
+	errorConfigName    string = "rule names must be unique, found two named"
+	errorConfigURL     string = "delegate url must be an absolute URL, got"
+	errorConfigTiming  string = "timing_allow_origin entries must be origin, '*' or an origin like https://example.com, got"
+	errorConfigIsolate string = "isolation:"
+	errorConfigValue   string = "header_values entries need a header and values or a max_length, got"
+	errorConfigMerge   string = "upstream_headers must be one of strip, merge or upstream, got"
+	errorConfigFail    string = "delegate fail must be closed or open, got"
+	errorFileIO        string = "file error"
 
 	// Common
-	allToken string = "*"
-	corsFile string = "corsFile"
+	allToken       string = "*"
+	defaultsRule   string = "defaults"
+	denyListRule   string = "deny_origins"
+	originToken    string = "origin"
+	originFuncRule string = "AllowOriginFunc"
+	delegateRule   string = "delegate"
+	metadataRule   string = "fetch_metadata"
+	csrfRule       string = "csrf"
+
+	// Rule reported when a failing policy service lets the request through
+	delegateFailedRule string = "delegate (failed open)"
+
+	// Characters that make a path entry a glob
+	globCharacters string = "*?["
+	corsFile       string = "corsFile"
+
+	// Configuration Versions
+	legacyVersion  int = 1
+	currentVersion int = 2
+
+	// Enforcement Modes
+	strictMode  string = "strict"
+	enforceMode string = "enforce"
+	reportMode  string = "report"
+
+	// Handling of Access-Control Headers Set Upstream
+	upstreamStrip string = "strip"
+	upstreamMerge string = "merge"
+	upstreamWins  string = "upstream"
+
+	// Prefix of the CORS response headers
+	corsHeaderPrefix string = "Access-Control-"
+
+	// Isolation Modes
+	isolationOverride string = "override"
+	isolationMerge    string = "merge"
+
+	// Logging Levels
+	logDenied string = "denied"
+	logAll    string = "all"
+	logNone   string = "none"
+
+	// How often a deny list file is checked for changes
+	denyListCheckInterval time.Duration = 5 * time.Second
+
+	// Cache Defaults, the TTL in seconds
+	defaultCacheSize int   = 1024
+	defaultCacheTTL  int64 = 60
+
+	// Policy Service Failure Handling, and its default timeout in milliseconds
+	failClosed             string = "closed"
+	failOpen               string = "open"
+	defaultDelegateTimeout int64  = 1000
+
+	// Metric Names
+	allowedMetric       string = "allowed"
+	deniedMetric        string = "denied."
+	delegateErrorMetric string = "delegate.errors"
+	cacheHitMetric      string = "cache.hits"
+	cacheMissMetric     string = "cache.misses"
+
+	// Configuration Formats
+	yamlFormat string = "yaml"
+	jsonFormat string = "json"
+	tomlFormat string = "toml"
+
+	// Explain Flags
+	originFlag string = "origin"
+	methodFlag string = "method"
+	headerFlag string = "header"
+	hostFlag   string = "host"
+	pathFlag   string = "path"
+
+	// Value of the headers explain sends without one
+	placeholderValue string = "placeholder"
+
+	// Migrate Flags
+	outFlag string = "out"
+
+	// Inline Configuration Flags
+	methodsFlag     string = "methods"
+	headersFlag     string = "headers"
+	exposeFlag      string = "expose"
+	maxAgeFlag      string = "max-age"
+	credentialsFlag string = "credentials"
 )
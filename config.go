@@ -0,0 +1,208 @@
+package cors
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// Matches origins configured as regex patterns, e.g. /http://[a-z]+\.skookum\.com/
+var patternSyntax = regexp.MustCompile("^/(.+)/$")
+
+// Reads the configuration file, if one was supplied.
+// Files without a version field are read as the bare origin map used before the schema was versioned.
+func readConfig(configFile string) (Middleware, error) {
+	var config Middleware
+	if configFile == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return config, fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+
+	format := configFormat(configFile, data)
+
+	var probe map[string]interface{}
+	if err := unmarshalConfig(format, data, &probe); err != nil {
+		return config, err
+	}
+
+	if _, ok := probe["version"]; ok {
+		err = unmarshalConfig(format, data, &config)
+	} else {
+		err = unmarshalConfig(format, data, &config.AllowedOrigins)
+	}
+
+	return config, err
+}
+
+// Moves the origins of a bare AllowedOrigins map into rules and fills in the defaults.
+func upgradeConfig(m *Middleware) {
+	if len(m.AllowedOrigins) > 0 {
+		var origins []string
+		for origin := range m.AllowedOrigins {
+			origins = append(origins, origin)
+		}
+		sort.Strings(origins)
+
+		for _, origin := range origins {
+			var cfg host
+			if m.AllowedOrigins[origin] != nil {
+				cfg = *m.AllowedOrigins[origin]
+			}
+
+			cfg.Name = origin
+			cfg.Origins = []string{origin}
+			m.Rules = append(m.Rules, &cfg)
+		}
+
+		m.AllowedOrigins = nil
+	}
+
+	if m.Version == 0 || m.Version == legacyVersion {
+		m.Version = currentVersion
+	}
+
+	if m.Defaults.Mode == "" {
+		m.Defaults.Mode = strictMode
+	}
+
+	if m.Defaults.Log == "" {
+		m.Defaults.Log = logDenied
+	}
+}
+
+// Migrate reads a configuration file and returns it in the current schema, using the same format.
+func Migrate(configFile string) ([]byte, error) {
+	config, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := ioutil.ReadFile(configFile)
+	return marshalConfig(configFormat(configFile, data), serializable(m))
+}
+
+// Returns a copy of the configuration holding only the fields it is serialized with. Some encoders,
+// such as TOML ones before v1.2, fail on hooks like AllowOriginFunc even when their tags skip them.
+func serializable(m *Middleware) interface{} {
+	v := reflect.ValueOf(*m)
+
+	var fields []reflect.StructField
+	var values []reflect.Value
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" || field.Type.Kind() == reflect.Func {
+			continue
+		}
+
+		fields = append(fields, field)
+		values = append(values, v.Field(i))
+	}
+
+	plain := reflect.New(reflect.StructOf(fields)).Elem()
+	for i, value := range values {
+		plain.Field(i).Set(value)
+	}
+
+	return plain.Interface()
+}
+
+// MigrateFromCli writes the configuration file given on the command line in the current schema.
+func MigrateFromCli(c *cli.Context) error {
+	data, err := Migrate(c.String(corsFile))
+	if err != nil {
+		return err
+	}
+
+	if out := c.String(outFlag); out != "" {
+		return ioutil.WriteFile(out, data, 0644)
+	}
+
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// MigrateCliFlags will be used to construct help and the `migrate` command
+func MigrateCliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{"corsFile, cf", "", "YAML, JSON or TOML configuration file", ""},
+		cli.StringFlag{outFlag, "", "file to write the migrated configuration to, defaults to stdout", ""},
+	}
+}
+
+// Decodes the configuration in the given format.
+func unmarshalConfig(format string, data []byte, v interface{}) error {
+	switch format {
+	case jsonFormat:
+		return json.Unmarshal(data, v)
+	case tomlFormat:
+		_, err := toml.Decode(string(data), v)
+		return err
+	}
+
+	return yaml.Unmarshal(data, v)
+}
+
+// Encodes the configuration in the given format.
+func marshalConfig(format string, v interface{}) ([]byte, error) {
+	switch format {
+	case jsonFormat:
+		data, err := json.MarshalIndent(v, "", "  ")
+		return append(data, '\n'), err
+	case tomlFormat:
+		var buf bytes.Buffer
+		err := toml.NewEncoder(&buf).Encode(v)
+		return buf.Bytes(), err
+	}
+
+	return yaml.Marshal(v)
+}
+
+// Detects the configuration format from the file extension, falling back to the content.
+func configFormat(configFile string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".json":
+		return jsonFormat
+	case ".toml":
+		return tomlFormat
+	case ".yml", ".yaml":
+		return yamlFormat
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			return jsonFormat
+		case strings.HasPrefix(line, "["):
+			return tomlFormat
+		}
+
+		break
+	}
+
+	return yamlFormat
+}
@@ -3,10 +3,11 @@ package cors
 import (
 	"errors"
 	"fmt"
-
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"log"
 	"net/http"
+	"path"
+	"regexp"
+	"strings"
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/plugin"
@@ -25,14 +26,21 @@ func GetSpec() *plugin.MiddlewareSpec {
 	}
 }
 
-// New checks input paramters and initializes the middleware
-func New(allowedOrigins map[string]*host) (*Middleware, error) {
-	_, err := validateConfig(allowedOrigins)
+// New checks input paramters and initializes the middleware.
+// A configuration still using the bare AllowedOrigins map is upgraded to the current schema.
+func New(m Middleware) (*Middleware, error) {
+	upgradeConfig(&m)
+
+	_, err := validateConfig(&m)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Middleware{allowedOrigins}, nil
+	for _, warning := range m.Lint() {
+		log.Println("cors: warning:", warning)
+	}
+
+	return &m, nil
 }
 
 // FromOther Will be called by Vulcand when engine or API will read the middleware from the serialized format.
@@ -40,59 +48,254 @@ func New(allowedOrigins map[string]*host) (*Middleware, error) {
 // The first and the only parameter should be the struct itself, no pointers and other variables.
 // Function should return middleware interface and error in case if the parameters are wrong.
 func FromOther(m Middleware) (plugin.Middleware, error) {
-	return New(m.AllowedOrigins)
+	return New(m)
 }
 
 // FromCli constructs the middleware from the command line.
 func FromCli(c *cli.Context) (plugin.Middleware, error) {
-	var suppliedConfig map[string]*host
+	suppliedConfig, err := readConfig(c.String(corsFile))
+	if err != nil {
+		return nil, err
+	}
 
-	configFile := c.String(corsFile)
-	if configFile != "" {
-		yamlFile, err := ioutil.ReadFile(configFile)
-		if err != nil {
-			fmt.Println(errorFileIO)
-		}
+	return New(inlineConfig(c, suppliedConfig))
+}
 
-		yaml.Unmarshal(yamlFile, &suppliedConfig)
+// Adds a rule for the origins supplied through command line flags to the configuration.
+func inlineConfig(c *cli.Context, config Middleware) Middleware {
+	origins := splitList(c.StringSlice(originFlag))
+	if len(origins) == 0 {
+		return config
 	}
 
-	return New(suppliedConfig)
+	config.Rules = append(config.Rules, &host{
+		Origins:       origins,
+		Methods:       splitList(c.StringSlice(methodsFlag)),
+		Headers:       splitList(c.StringSlice(headersFlag)),
+		ExposeHeaders: splitList(c.StringSlice(exposeFlag)),
+		Credentials:   c.Bool(credentialsFlag),
+		MaxAge:        int64(c.Int(maxAgeFlag)),
+	})
+
+	return config
 }
 
 // CliFlags will be used by Vulcan construct help and CLI command for `vctl`
 func CliFlags() []cli.Flag {
 	return []cli.Flag{
-		cli.StringFlag{"corsFile, cf", "", "YAML configuration file", ""},
+		cli.StringFlag{"corsFile, cf", "", "YAML, JSON or TOML configuration file", ""},
+		cli.StringSliceFlag{originFlag, &cli.StringSlice{}, "allowed origin, may be repeated", ""},
+		cli.StringSliceFlag{methodsFlag, &cli.StringSlice{}, "methods allowed for the inline origins", ""},
+		cli.StringSliceFlag{headersFlag, &cli.StringSlice{}, "headers allowed for the inline origins", ""},
+		cli.StringSliceFlag{exposeFlag, &cli.StringSlice{}, "headers exposed to the inline origins", ""},
+		cli.IntFlag{maxAgeFlag, 0, "preflight max age for the inline origins", ""},
+		cli.BoolFlag{credentialsFlag, "allow credentials for the inline origins", ""},
 	}
 }
 
 // Validates the configuration file.
-func validateConfig(origins map[string]*host) (bool, error) {
-	if len(origins) == 0 {
-		return false, errors.New(errorConfigOrigin)
+func validateConfig(m *Middleware) (bool, error) {
+	if m.Version != currentVersion {
+		return false, fmt.Errorf("%s %v", errorConfigVersion, m.Version)
+	}
+
+	if !stringInSlice(m.Defaults.Mode, []string{strictMode, enforceMode, reportMode}) {
+		return false, fmt.Errorf("%s %q", errorConfigMode, m.Defaults.Mode)
+	}
+
+	if !stringInSlice(m.Defaults.Log, []string{logDenied, logAll, logNone}) {
+		return false, fmt.Errorf("%s %q", errorConfigLog, m.Defaults.Log)
+	}
+
+	if !stringInSlice(m.Defaults.UpstreamHeaders, []string{"", upstreamStrip, upstreamMerge, upstreamWins}) {
+		return false, fmt.Errorf("%s %q", errorConfigMerge, m.Defaults.UpstreamHeaders)
+	}
+
+	if m.DecisionCache != nil {
+		m.decisions = newLRU(*m.DecisionCache)
 	}
 
-	for origin, cfg := range origins {
-		if origin == "" {
+	denied, err := newDenyList(m.DenyOrigins, m.DenyOriginsFile, m.decisions)
+	if err != nil {
+		return false, err
+	}
+	m.denied = denied
+
+	if m.AllowOriginFunc != nil {
+		m.dynamic = newLRU(m.OriginCache)
+	}
+
+	if m.Delegate != nil {
+		if err := m.Delegate.init(); err != nil {
+			return false, err
+		}
+	}
+
+	m.Defaults.Headers = canonicalHeaders(m.Defaults.Headers)
+	m.Defaults.ExposeHeaders = canonicalHeaders(m.Defaults.ExposeHeaders)
+	m.Defaults.Methods = upperMethods(m.Defaults.Methods)
+
+	if m.CSRF != nil {
+		if err := validatePaths(m.CSRF.ExemptPaths); err != nil {
+			return false, err
+		}
+	}
+
+	if m.FetchMetadata != nil {
+		if err := validatePaths(m.FetchMetadata.Paths); err != nil {
+			return false, err
+		}
+	}
+
+	for _, iso := range m.Isolation {
+		if err := iso.validate(); err != nil {
+			return false, err
+		}
+	}
+
+	for _, vh := range m.VirtualHosts {
+		if len(vh.Hosts) == 0 {
+			return false, fmt.Errorf("%s %q", errorConfigHost, vh.Name)
+		}
+
+		for i, h := range vh.Hosts {
+			if h == "" || strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+				return false, fmt.Errorf("%s %q", errorConfigHost, h)
+			}
+
+			vh.Hosts[i] = strings.ToLower(h)
+		}
+	}
+
+	origins := 0
+	m.patterns = map[string]*regexp.Regexp{}
+	for _, cfg := range m.allRules() {
+		if cfg.OriginsFile != "" {
+			loaded, err := loadOrigins(cfg.OriginsFile)
+			if err != nil {
+				return false, err
+			}
+
+			cfg.allOrigins = append(append([]string{}, cfg.Origins...), loaded...)
+		}
+
+		if len(cfg.origins()) == 0 && cfg.Name == "" {
 			return false, errors.New(errorConfigOrigin)
 		}
 
-		if len(cfg.Methods) == 0 {
+		for _, origin := range append(append([]string{}, cfg.origins()...), cfg.ExceptOrigins...) {
+			if origin == "" {
+				return false, errors.New(errorConfigOrigin)
+			}
+
+			if match := patternSyntax.FindStringSubmatch(origin); match != nil {
+				re, err := regexp.Compile(fmt.Sprintf("^%s$", match[1]))
+				if err != nil {
+					return false, fmt.Errorf("%s %v: %v", errorConfigPattern, origin, err)
+				}
+
+				m.patterns[origin] = re
+			} else if _, err := path.Match(origin, ""); err != nil {
+				return false, fmt.Errorf("%s %v: %v", errorConfigPattern, origin, err)
+			}
+		}
+
+		if cfg.Isolation != nil {
+			if len(cfg.Isolation.Paths) > 0 {
+				return false, fmt.Errorf("%s rules scope isolation with their own paths, got %v", errorConfigIsolate, cfg.Isolation.Paths)
+			} else if err := cfg.Isolation.validate(); err != nil {
+				return false, err
+			}
+		}
+
+		for _, o := range cfg.TimingAllowOrigin {
+			if o != allToken && o != originToken && !strings.Contains(o, "://") {
+				return false, fmt.Errorf("%s %q", errorConfigTiming, o)
+			}
+		}
+
+		if err := validatePaths(cfg.Paths); err != nil {
+			return false, err
+		}
+
+		for _, constraint := range cfg.HeaderValues {
+			if err := constraint.validate(); err != nil {
+				return false, err
+			}
+
+			constraint.Header = http.CanonicalHeaderKey(constraint.Header)
+			m.constrained = union(m.constrained, []string{constraint.Header})
+
+			for _, value := range constraint.Values {
+				if match := patternSyntax.FindStringSubmatch(value); match != nil {
+					re, err := regexp.Compile(fmt.Sprintf("^%s$", match[1]))
+					if err != nil {
+						return false, fmt.Errorf("%s %v: %v", errorConfigValue, value, err)
+					}
+
+					m.patterns[value] = re
+				}
+			}
+		}
+
+		if !cfg.Deny {
+			origins += len(cfg.origins())
+		}
+
+		cfg.Headers = canonicalHeaders(cfg.Headers)
+		cfg.ExceptHeaders = canonicalHeaders(cfg.ExceptHeaders)
+		cfg.ExposeHeaders = canonicalHeaders(cfg.ExposeHeaders)
+		cfg.RemoveHeaders = canonicalHeaders(cfg.RemoveHeaders)
+		cfg.RemoveExposeHeaders = canonicalHeaders(cfg.RemoveExposeHeaders)
+		cfg.Methods = upperMethods(cfg.Methods)
+		cfg.ExceptMethods = upperMethods(cfg.ExceptMethods)
+		cfg.RemoveMethods = upperMethods(cfg.RemoveMethods)
+		cfg.RequireHeaders = canonicalHeaders(cfg.RequireHeaders)
+		m.required = union(m.required, cfg.RequireHeaders)
+	}
+
+	if origins == 0 && m.AllowOriginFunc == nil && m.Delegate == nil {
+		return false, errors.New(errorConfigOrigin)
+	}
+
+	if err := resolveRules(m); err != nil {
+		return false, err
+	}
+
+	for _, cfg := range m.allRules() {
+		if len(cfg.origins()) == 0 || cfg.Deny {
+			continue
+		}
+
+		if len(cfg.policy().Methods) == 0 {
 			return false, errors.New(errorConfigMethod)
 		}
 
-		if len(cfg.Headers) == 0 {
+		if len(cfg.policy().Headers) == 0 {
 			return false, errors.New(errorConfigHeader)
 		}
+	}
 
-		var canonicalHeaders []string
-		for _, h := range cfg.Headers {
-			canonicalHeaders = append(canonicalHeaders, http.CanonicalHeaderKey(h))
-		}
+	if m.matcher, err = newOriginMatcher(m.Rules); err != nil {
+		return false, err
+	}
 
-		cfg.Headers = canonicalHeaders
+	for _, vh := range m.VirtualHosts {
+		if vh.matcher, err = newOriginMatcher(vh.Rules); err != nil {
+			return false, err
+		}
 	}
 
 	return true, nil
 }
+
+// Validates path entries, which must start with "/" and be valid globs.
+func validatePaths(paths []string) error {
+	for _, p := range paths {
+		if _, err := path.Match(p, ""); err != nil || !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("%s %q", errorConfigPath, p)
+		}
+	}
+
+	return nil
+}
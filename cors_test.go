@@ -1,11 +1,23 @@
 package cors
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/plugin"
@@ -24,70 +36,2022 @@ func readConfigFile() (map[string]*host, error) {
 	return config, nil
 }
 
+// Helper method to create the middleware from an inline YAML configuration.
+func newFromYAML(config string) (*Middleware, error) {
+	var m Middleware
+	if err := yaml.Unmarshal([]byte(config), &m); err != nil {
+		return nil, err
+	}
+
+	return New(m)
+}
+
 func setupTestServer(key string) *httptest.Server {
 	data, _ := readConfigFile()
 	config := map[string]*host{key: data[key]}
-	cors, _ := New(config)
+	cors, _ := New(Middleware{AllowedOrigins: config})
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler, _ := cors.NewHandler(next)
+
+	return httptest.NewServer(handler)
+}
+
+func setupTestRequest(method string, url string, origin string) *http.Request {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Add("Origin", origin)
+
+	return req
+}
+
+func TestSpecIsOK(t *testing.T) {
+	t.Log("Add CORS Middleware spec to Vulcan registry")
+
+	err := plugin.NewRegistry().AddSpec(GetSpec())
+	if err != nil {
+		t.Errorf("Expected to be able to add spec but got error %+v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Log("Creating CORS Middleware with New method")
+
+	config, err := readConfigFile()
+	if err != nil {
+		t.Errorf("Received error while processing config file: %+v", err)
+	}
+
+	cm, err := New(Middleware{AllowedOrigins: config})
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	if cm == nil {
+		t.Errorf("Expected a CORS Middleware instance but got %+v", cm)
+	}
+
+	if cm.String() == "" {
+		t.Errorf("Expected middleware string %+v but got empty string", cm)
+	}
+
+	handler, err := cm.NewHandler(nil)
+	if err != nil {
+		t.Errorf("Expected to received a handler but got error: %+v", err)
+	}
+
+	if handler == nil {
+		t.Errorf("Expected a CORS Handler instance but got %+v", handler)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Log("Creating CORS Middleware with invalid data")
+
+	_, err := New(Middleware{})
+	if err == nil {
+		t.Errorf("Expected to receive an error but got %+v", err)
+	}
+}
+
+func TestNewUnsupportedVersion(t *testing.T) {
+	t.Log("Refuse configurations from a newer schema version")
+
+	_, err := New(Middleware{Version: 3, Rules: []*host{{Origins: []string{"*"}, Methods: []string{"GET"}, Headers: []string{"*"}}}})
+	if err == nil {
+		t.Errorf("Expected to receive an error but got %+v", err)
+	}
+}
+
+func TestUpgradeLegacyConfig(t *testing.T) {
+	t.Log("Upgrade a bare origin map to the versioned schema")
+
+	config, _ := readConfigFile()
+	cm, err := New(Middleware{AllowedOrigins: config})
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	if cm.Version != currentVersion || cm.AllowedOrigins != nil {
+		t.Errorf("Expected version %v without origin map but got %+v", currentVersion, cm)
+	}
+
+	if cm.Defaults.Mode != strictMode || cm.Defaults.Log != logDenied {
+		t.Errorf("Expected mode %v and log %v but got %+v", strictMode, logDenied, cm.Defaults)
+	}
+
+	if cm.Rules[0].Name != allToken || !reflect.DeepEqual(cm.Rules[0].Origins, []string{allToken}) {
+		t.Errorf("Expected first rule for %v but got %+v", allToken, cm.Rules[0])
+	}
+}
+
+func TestVersionedConfig(t *testing.T) {
+	t.Log("Read a configuration file using the versioned schema")
+
+	config, err := readConfig("test_v2.yml")
+	if err != nil {
+		t.Errorf("Received error while processing config file: %+v", err)
+	}
+
+	cm, err := New(config)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	origins := map[string]string{
+		"http://skookum.com":      "skookum",
+		"http://blog.skookum.com": "skookum",
+		"http://skookum.org":      "everyone",
+	}
+
+	for origin, expected := range origins {
+		_, rule := cm.matchOrigin(origin, "", "/")
+		if rule == nil || rule.Name != expected {
+			t.Errorf("Expected %v to match rule %v but got %+v", origin, expected, rule)
+		}
+	}
+
+	maxAges := map[string]int64{"http://skookum.com": 86500, "http://skookum.org": 600}
+	for origin, expected := range maxAges {
+		maxAge := cm.maxAgeForOrigin(origin, "", "/")
+		if maxAge != expected {
+			t.Errorf("Expected max age %v for %v but got %v", expected, origin, maxAge)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Log("Migrate a bare origin map file to the versioned schema")
+
+	for _, file := range []string{"test.yml", "test.json", "test.toml"} {
+		data, err := Migrate(file)
+		if err != nil {
+			t.Errorf("Expected to migrate %v but got error: %+v", file, err)
+		}
+
+		dir, _ := ioutil.TempDir("", "cors")
+		defer os.RemoveAll(dir)
+
+		migrated := filepath.Join(dir, filepath.Base(file))
+		ioutil.WriteFile(migrated, data, 0644)
+
+		config, err := readConfig(migrated)
+		if err != nil || config.Version != currentVersion {
+			t.Errorf("Expected to read version %v from migrated %v but got %v (%+v)", currentVersion, file, config.Version, err)
+		}
+
+		cm, _ := New(config)
+		legacy, _ := readConfig(file)
+		expected, _ := New(legacy)
+		if !reflect.DeepEqual(cm, expected) {
+			t.Errorf("Expected migrated %v to equal %v but got %v", file, expected, cm)
+		}
+	}
+}
+
+func TestExtendDefaults(t *testing.T) {
+	t.Log("Rules extending the defaults add to and remove from the default policy")
+
+	cm, err := newFromYAML(`
+version: 2
+defaults:
+  methods: [GET, PATCH, DELETE]
+  headers: [Accept, Content-Type]
+  max_age: 600
+rules:
+  - origins: [http://skookum.com]
+    extend: defaults
+    headers: [x-extra]
+    remove_methods: [DELETE]
+    remove_headers: [content-type]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	_, policy := cm.matchOrigin("http://skookum.com", "", "/")
+	if !reflect.DeepEqual(policy.Methods, []string{"GET", "PATCH"}) {
+		t.Errorf("Expected methods %v but got %v", []string{"GET", "PATCH"}, policy.Methods)
+	}
+
+	if !reflect.DeepEqual(policy.Headers, []string{"Accept", "X-Extra"}) {
+		t.Errorf("Expected headers %v but got %v", []string{"Accept", "X-Extra"}, policy.Headers)
+	}
+
+	if policy.MaxAge != 600 {
+		t.Errorf("Expected max age %v but got %v", 600, policy.MaxAge)
+	}
+
+	if cm.Rules[0].Methods != nil {
+		t.Errorf("Expected the configured rule to be left as written but got methods %v", cm.Rules[0].Methods)
+	}
+}
+
+func TestExtendNamedBase(t *testing.T) {
+	t.Log("Rules extending a named base inherit its policy")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - name: base
+    methods: [GET]
+    headers: [Accept]
+    expose_headers: [X-Total-Count, X-Page]
+    credentials: true
+  - name: partner
+    origins: [http://partner.com]
+    extend: base
+    methods: [POST]
+    remove_expose_headers: [x-page]
+  - name: reseller
+    origins: [http://reseller.com]
+    extend: partner
+    headers: [X-Reseller]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	if rule, _ := cm.matchOrigin("base", "", "/"); rule != "" {
+		t.Errorf("Expected a rule without origins to match nothing but it matched %v", rule)
+	}
+
+	_, policy := cm.matchOrigin("http://reseller.com", "", "/")
+	if !reflect.DeepEqual(policy.Methods, []string{"GET", "POST"}) {
+		t.Errorf("Expected methods %v but got %v", []string{"GET", "POST"}, policy.Methods)
+	}
+
+	if !reflect.DeepEqual(policy.Headers, []string{"Accept", "X-Reseller"}) {
+		t.Errorf("Expected headers %v but got %v", []string{"Accept", "X-Reseller"}, policy.Headers)
+	}
+
+	if !reflect.DeepEqual(policy.ExposeHeaders, []string{"X-Total-Count"}) || !policy.Credentials {
+		t.Errorf("Expected inherited expose headers and credentials but got %+v", policy)
+	}
+}
+
+func TestExtendInvalid(t *testing.T) {
+	t.Log("Refuse rules extending unknown rules or each other in a cycle")
+
+	configs := []string{`
+version: 2
+rules:
+  - origins: [http://skookum.com]
+    extend: missing
+`, `
+version: 2
+rules:
+  - name: a
+    origins: [http://a.com]
+    extend: b
+  - name: b
+    origins: [http://b.com]
+    extend: a
+`}
+
+	for _, config := range configs {
+		if _, err := newFromYAML(config); err == nil {
+			t.Errorf("Expected to receive an error but got %+v", err)
+		}
+	}
+}
+
+func TestPathScopes(t *testing.T) {
+	t.Log("Rules scoped to the most specific matching path win, without falling back to broader scopes")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - name: everyone
+    origins: ["*"]
+    methods: [GET]
+    headers: [Accept]
+  - name: api
+    origins: ["*"]
+    paths: [/api/*]
+    methods: [GET, POST]
+    headers: [Accept]
+    max_age: 60
+  - name: console
+    origins: [http://console.com]
+    paths: [/api/admin]
+    methods: ["*"]
+    headers: ["*"]
+    credentials: true
+  - name: reports
+    origins: [http://console.com]
+    paths: ["/api/*/reports"]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	cases := []struct {
+		origin string
+		path   string
+		rule   string
+	}{
+		{"http://skookum.com", "/", "everyone"},
+		{"http://skookum.com", "/apis", "everyone"},
+		{"http://skookum.com", "/api/public/things", "api"},
+		{"http://console.com", "/api/admin", "console"},
+		{"http://console.com", "/api/admin/users", "console"},
+		{"http://skookum.com", "/api/admin/users", ""},
+		{"http://skookum.com", "/api/administrators", "api"},
+		{"http://console.com", "/api/sales/reports", "reports"},
+		{"http://console.com", "/api/admin/reports", "reports"},
+	}
+
+	for _, c := range cases {
+		_, policy := cm.matchOrigin(c.origin, "", c.path)
+		if c.rule == "" && policy != nil {
+			t.Errorf("Expected %v on %v to be denied but it matched %v", c.origin, c.path, policy.Name)
+		} else if c.rule != "" && (policy == nil || policy.Name != c.rule) {
+			t.Errorf("Expected %v on %v to match %v but got %+v", c.origin, c.path, c.rule, policy)
+		}
+	}
+
+	if maxAge := cm.maxAgeForOrigin("http://skookum.com", "", "/api/things"); maxAge != 60 {
+		t.Errorf("Expected max age %v but got %v", 60, maxAge)
+	}
+
+	preflight, _, _ := cm.Explain("http://console.com", "DELETE", nil, "", "/api/admin/users")
+	if !preflight.Allowed || preflight.Scope != "/api/admin" || preflight.Header.Get(credentialsHeader) != "true" {
+		t.Errorf("Expected the console scope to allow the preflight with credentials but got %+v", preflight)
+	}
+}
+
+func TestInvalidPathScope(t *testing.T) {
+	t.Log("Refuse path scopes that are not absolute or are broken globs")
+
+	for _, p := range []string{"api", "/api/[a-"} {
+		_, err := New(Middleware{Rules: []*host{{Origins: []string{"*"}, Paths: []string{p}, Methods: []string{"GET"}, Headers: []string{"*"}}}})
+		if err == nil {
+			t.Errorf("Expected to receive an error for %v but got %+v", p, err)
+		}
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	t.Log("Select the rules of the virtual host matching the request host before matching the origin")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - name: everyone
+    origins: ["*"]
+    methods: [GET]
+    headers: [Accept]
+virtual_hosts:
+  - name: acme
+    hosts: [api.acme.com, "*.acme.com"]
+    rules:
+      - origins: [http://acme.com]
+        extend: everyone
+        methods: [POST]
+  - hosts: [Beta.Acme.com]
+    rules:
+      - origins: [http://beta.com]
+        methods: [GET]
+        headers: [Accept]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	cases := []struct {
+		origin      string
+		host        string
+		allowed     bool
+		virtualHost string
+	}{
+		{"http://acme.com", "api.acme.com:8080", true, "acme"},
+		{"http://acme.com", "eu.api.acme.com", true, "acme"},
+		{"http://beta.com", "beta.acme.com", true, "beta.acme.com"},
+		{"http://acme.com", "beta.acme.com", false, "beta.acme.com"},
+		{"http://other.com", "x.acme.com", false, "acme"},
+		{"http://other.com", "acme.com", true, ""},
+	}
+
+	for _, c := range cases {
+		_, actual, _ := cm.Explain(c.origin, "GET", nil, c.host, "/")
+		if actual.Allowed != c.allowed || actual.VirtualHost != c.virtualHost {
+			t.Errorf("Expected %v on %v allowed to be %v by %q but got %+v", c.origin, c.host, c.allowed, c.virtualHost, actual)
+		}
+	}
+
+	preflight, _, _ := cm.Explain("http://acme.com", "POST", nil, "api.acme.com", "/")
+	if !preflight.Allowed || preflight.Header.Get(allowMethodsHeader) != "POST" {
+		t.Errorf("Expected the acme rule to allow POST but got %+v", preflight)
+	}
+
+	if !strings.Contains(cm.String(), "virtual_hosts=[acme beta.acme.com]") {
+		t.Errorf("Expected middleware string to list the virtual hosts but got %v", cm.String())
+	}
+}
+
+func TestInvalidVirtualHost(t *testing.T) {
+	t.Log("Refuse virtual hosts without hosts or with misplaced wildcards")
+
+	for _, hosts := range [][]string{nil, {"api.*.com"}} {
+		rules := []*host{{Origins: []string{"*"}, Methods: []string{"GET"}, Headers: []string{"*"}}}
+		_, err := New(Middleware{Rules: rules, VirtualHosts: []*vhost{{Hosts: hosts, Rules: rules}}})
+		if err == nil {
+			t.Errorf("Expected to receive an error for %v but got %+v", hosts, err)
+		}
+	}
+}
+
+func TestHeaderPatterns(t *testing.T) {
+	t.Log("Allow headers matching prefix patterns regardless of case")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: ["*"]
+    methods: [GET]
+    headers: [Accept, x-client-*, X-AMZ-*]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	allowed := map[string]bool{
+		"x-client-id":          true,
+		"X-Client-Version":     true,
+		"accept, x-amz-date":   true,
+		"X-Client":             false,
+		"x-amz-date,x-partner": false,
+	}
+
+	for headers, expected := range allowed {
+		preflight, _, _ := cm.Explain("http://skookum.com", "GET", []string{headers}, "", "/")
+		if preflight.Allowed != expected {
+			t.Errorf("Expected headers %v allowed to be %v but got %+v", headers, expected, preflight)
+		}
+	}
+}
+
+func TestExposeHeaderPatterns(t *testing.T) {
+	t.Log("Expose upstream headers matching prefix patterns")
+
+	cm, _ := newFromYAML(`
+version: 2
+rules:
+  - origins: ["*"]
+    methods: [GET]
+    headers: [Accept]
+    expose_headers: [X-Total-Count, x-client-*]
+`)
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client-Version", "2")
+		w.Header().Set("X-Other", "hidden")
+		w.Write([]byte("ok"))
+	}))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, setupTestRequest("GET", "/", "http://skookum.com"))
+
+	resExpose := res.Header().Get(exposeHeader)
+	if resExpose != "X-Total-Count, X-Client-Version" {
+		t.Errorf("Expected expose header %v but it was %v", "X-Total-Count, X-Client-Version", resExpose)
+	}
+
+	if res.Body.String() != "ok" {
+		t.Errorf("Expected upstream body %v but it was %v", "ok", res.Body.String())
+	}
+}
+
+func TestLintSensitivePatterns(t *testing.T) {
+	t.Log("Warn about header patterns covering sensitive headers")
+
+	cm, _ := newFromYAML(`
+version: 2
+rules:
+  - name: partners
+    origins: ["*"]
+    methods: [GET]
+    headers: [Auth*, X-Client-*, "*"]
+    expose_headers: [Set-*]
+`)
+
+	warnings := cm.Lint()
+	expected := []string{
+		`rule "partners": header pattern "Auth*" also allows Authorization`,
+		`rule "partners": header pattern "Set-*" also exposes Set-Cookie`,
+	}
+
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("Expected warnings %v but got %v", expected, warnings)
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	t.Log("Excluded methods, headers and origins take precedence over what a rule allows")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - name: example
+    origins: [http://*.example.com, http://legacy.example.com]
+    except_origins: [http://legacy.example.com, '/http://old[0-9]+\.example\.com/']
+    methods: ["*"]
+    except_methods: [DELETE, TRACE]
+    headers: ["*", X-Client-*]
+    except_headers: [x-client-secret, X-Debug-*]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	cases := []struct {
+		origin  string
+		method  string
+		headers []string
+		reason  string
+	}{
+		{"http://www.example.com", "PUT", []string{"X-Client-Id", "Accept"}, ""},
+		{"http://www.example.com", "DELETE", nil, errorBadMethod},
+		{"http://www.example.com", "TRACE", nil, errorBadMethod},
+		{"http://www.example.com", "GET", []string{"X-Client-Secret"}, errorBadHeader},
+		{"http://www.example.com", "GET", []string{"x-debug-level"}, errorBadHeader},
+		{"http://legacy.example.com", "GET", nil, errorBadOrigin},
+		{"http://old42.example.com", "GET", nil, errorBadOrigin},
+		{"http://example.org", "GET", nil, errorBadOrigin},
+	}
+
+	for _, c := range cases {
+		preflight, _, _ := cm.Explain(c.origin, c.method, c.headers, "", "/")
+		if preflight.Reason != c.reason {
+			t.Errorf("Expected %v %v %v to be denied for %q but got %+v", c.origin, c.method, c.headers, c.reason, preflight)
+		}
+	}
+}
+
+func TestDenyRules(t *testing.T) {
+	t.Log("Deny rules refuse origins even when a more specific rule allows them")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - name: everyone
+    origins: ["*"]
+    methods: [GET]
+    headers: ["*"]
+  - name: partner
+    origins: [http://partner.example.com]
+    paths: [/api]
+    methods: ["*"]
+    headers: ["*"]
+  - name: blocked
+    deny: true
+    origins: [http://*.example.com]
+    except_origins: [http://www.example.com]
+  - name: blocked-admin
+    deny: true
+    paths: [/admin]
+    origins: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	cases := []struct {
+		origin string
+		path   string
+		rule   string
+		reason string
+	}{
+		{"http://partner.example.com", "/api/things", "blocked", errorDeniedOrigin},
+		{"http://www.example.com", "/", "everyone", ""},
+		{"http://skookum.com", "/admin/users", "blocked-admin", errorDeniedOrigin},
+		{"http://skookum.com", "/", "everyone", ""},
+	}
+
+	for _, c := range cases {
+		_, actual, _ := cm.Explain(c.origin, "GET", nil, "", c.path)
+		if actual.Rule != c.rule || actual.Reason != c.reason {
+			t.Errorf("Expected %v on %v to be decided by %v for %q but got %+v", c.origin, c.path, c.rule, c.reason, actual)
+		}
+	}
+}
+
+func TestDenyOrigins(t *testing.T) {
+	t.Log("Deny origins on the global deny list before any rule is considered")
+
+	cm, err := newFromYAML(`
+version: 2
+deny_origins:
+  - http://evil.com
+  - http://*.evil.org
+  - '/http://[0-9]+\.example\.com/'
+rules:
+  - origins: [http://evil.com, "*"]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	cases := map[string]string{
+		"http://evil.com":        errorBlockedOrigin,
+		"http://www.evil.org":    errorBlockedOrigin,
+		"http://42.example.com":  errorBlockedOrigin,
+		"http://www.example.com": "",
+		"http://notevil.com":     "",
+	}
+
+	for origin, reason := range cases {
+		_, actual, _ := cm.Explain(origin, "GET", nil, "", "/")
+		if actual.Reason != reason {
+			t.Errorf("Expected %v to be decided for %q but got %+v", origin, reason, actual)
+		}
+
+		if reason != "" && actual.Rule != denyListRule {
+			t.Errorf("Expected rule %v but got %v", denyListRule, actual.Rule)
+		}
+	}
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	key := deniedMetric + "blocked_host"
+	before, _ := metrics.Get(key).(*expvar.Int)
+	res, _ := (&http.Client{}).Do(setupTestRequest("GET", server.URL, "http://evil.com"))
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected HTTP status %v but it was %v", http.StatusForbidden, res.StatusCode)
+	}
+
+	after := metrics.Get(key).(*expvar.Int)
+	if before != nil && after.Value() != before.Value()+1 || before == nil && after.Value() != 1 {
+		t.Errorf("Expected the %v metric to count the denial but it was %v", key, after)
+	}
+}
+
+func TestReloadDenyOrigins(t *testing.T) {
+	t.Log("Reload the deny list file without rebuilding the middleware")
+
+	dir, _ := ioutil.TempDir("", "cors")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "deny.txt")
+	ioutil.WriteFile(file, []byte("# blocked partners\nhttp://evil.com\n\n"), 0644)
+
+	cm, err := New(Middleware{
+		Version:         currentVersion,
+		DenyOriginsFile: file,
+		Rules:           []*host{{Origins: []string{"*"}, Methods: []string{"GET"}, Headers: []string{"*"}}},
+	})
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	if _, actual, _ := cm.Explain("http://evil.com", "GET", nil, "", "/"); actual.Reason != errorBlockedOrigin {
+		t.Errorf("Expected origin on the deny list file to be blocked but got %+v", actual)
+	}
+
+	ioutil.WriteFile(file, []byte("http://other.com\n"), 0644)
+	if err := cm.ReloadDenyOrigins(); err != nil {
+		t.Errorf("Expected to reload deny list but got error: %+v", err)
+	}
+
+	if _, actual, _ := cm.Explain("http://evil.com", "GET", nil, "", "/"); !actual.Allowed {
+		t.Errorf("Expected origin removed from the deny list file to be allowed but got %+v", actual)
+	}
+
+	if _, actual, _ := cm.Explain("http://other.com", "GET", nil, "", "/"); actual.Reason != errorBlockedOrigin {
+		t.Errorf("Expected origin added to the deny list file to be blocked but got %+v", actual)
+	}
+
+	if _, err := New(Middleware{Version: currentVersion, DenyOriginsFile: filepath.Join(dir, "missing.txt"), Rules: cm.Rules}); err == nil {
+		t.Errorf("Expected a missing deny list file to fail but got no error")
+	}
+}
+
+func TestAllowOriginFunc(t *testing.T) {
+	t.Log("Consult AllowOriginFunc for origins no rule matches and cache its answers")
+
+	calls := 0
+	tenants := map[string]bool{"https://acme.example.com": true}
+	cm, err := New(Middleware{
+		Rules: []*host{{Origins: []string{"http://skookum.com"}, Methods: []string{"GET"}, Headers: []string{"Accept"}}},
+		AllowOriginFunc: func(r *http.Request, origin string) (Policy, bool) {
+			calls++
+			return Policy{Methods: []string{"GET", "PUT"}, Headers: []string{"x-tenant"}, MaxAge: 300}, tenants[origin]
+		},
+	})
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	preflight, actual, _ := cm.Explain("https://acme.example.com", "PUT", []string{"X-Tenant"}, "", "/")
+	if !preflight.Allowed || !actual.Allowed || actual.Rule != originFuncRule {
+		t.Errorf("Expected tenant origin to be allowed by %v but got %+v", originFuncRule, actual)
+	}
+
+	if preflight.Header.Get(maxAgeHeader) != "300" {
+		t.Errorf("Expected preflight Max Age header %v but it was %v", "300", preflight.Header.Get(maxAgeHeader))
+	}
+
+	if _, actual, _ := cm.Explain("https://other.example.com", "GET", nil, "", "/"); actual.Reason != errorBadOrigin {
+		t.Errorf("Expected unknown origin to be denied with %v but got %+v", errorBadOrigin, actual)
+	}
+
+	if _, actual, _ := cm.Explain("http://skookum.com", "GET", nil, "", "/"); actual.Rule != "http://skookum.com" {
+		t.Errorf("Expected configured origin to be matched by its rule but got %+v", actual)
+	}
+
+	tenants["https://other.example.com"] = true
+	cm.Explain("https://acme.example.com", "PUT", nil, "", "/")
+	if _, actual, _ := cm.Explain("https://other.example.com", "GET", nil, "", "/"); actual.Allowed {
+		t.Errorf("Expected cached denial to be used but got %+v", actual)
+	}
+
+	if calls != 2 {
+		t.Errorf("Expected AllowOriginFunc to be called %v times but it was called %v times", 2, calls)
+	}
+}
+
+func TestOriginCache(t *testing.T) {
+	t.Log("Evict the least recently used entries and expire stale ones")
+
+	c := newLRU(cacheConfig{Size: 2})
+	c.add("a", 1)
+	c.add("b", 2)
+	c.get("a")
+	c.add("c", 3)
+
+	if _, ok := c.get("b"); ok {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("Expected entry %v to be cached", key)
+		}
+	}
+
+	c.ttl = -time.Second
+	c.add("d", 4)
+	if _, ok := c.get("d"); ok {
+		t.Errorf("Expected expired entry to be dropped")
+	}
+}
+
+// Helper method to start a stub policy service allowing GET requests from the given origin.
+func setupPolicyService(origin string, calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+
+		var req delegateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(delegateResponse{
+			Allowed:       req.Origin == origin && req.Method == "GET" && req.Path == "/api",
+			ExposeHeaders: []string{"X-Tenant"},
+			MaxAge:        120,
+		})
+	}))
+}
+
+func TestDelegate(t *testing.T) {
+	t.Log("Ask the policy service about requests no rule matches and cache its answers")
+
+	calls := 0
+	service := setupPolicyService("https://tenant.example.com", &calls)
+	defer service.Close()
+
+	cm, err := newFromYAML(`
+version: 2
+delegate:
+  url: ` + service.URL + `
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	preflight, actual, _ := cm.Explain("https://tenant.example.com", "GET", []string{"x-requested-with"}, "api.example.com", "/api")
+	if !preflight.Allowed || !actual.Allowed || actual.Rule != delegateRule {
+		t.Errorf("Expected request to be allowed by %v but got %+v", delegateRule, actual)
+	}
+
+	if preflight.Header.Get(maxAgeHeader) != "120" || actual.Header.Get(exposeHeader) != "X-Tenant" {
+		t.Errorf("Expected the policy service's max age and exposed headers but got %+v and %+v", preflight.Header, actual.Header)
+	}
+
+	if _, actual, _ := cm.Explain("https://tenant.example.com", "DELETE", nil, "api.example.com", "/api"); actual.Reason != errorBadOrigin {
+		t.Errorf("Expected request refused by the policy service to be denied with %v but got %+v", errorBadOrigin, actual)
+	}
+
+	cm.Explain("https://tenant.example.com", "GET", []string{"x-requested-with"}, "api.example.com", "/api")
+	if calls != 3 {
+		t.Errorf("Expected the policy service to be called %v times but it was called %v times", 3, calls)
+	}
+}
+
+func TestDelegateFailure(t *testing.T) {
+	t.Log("Fail closed or open when the policy service can't be reached")
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer service.Close()
+
+	cases := map[string]string{failClosed: errorDelegate, failOpen: ""}
+	for fail, reason := range cases {
+		cm, err := New(Middleware{Delegate: &delegate{URL: service.URL, Fail: fail}})
+		if err != nil {
+			t.Errorf("Expected to create middleware but got error: %+v", err)
+		}
+
+		if _, actual, _ := cm.Explain("https://tenant.example.com", "GET", nil, "", "/"); actual.Reason != reason {
+			t.Errorf("Expected failing %v to be decided for %q but got %+v", fail, reason, actual)
+		}
+	}
+
+	if _, err := New(Middleware{Delegate: &delegate{URL: "policy"}}); err == nil {
+		t.Errorf("Expected a relative policy service URL to fail but got no error")
+	}
+}
+
+func TestOriginsFile(t *testing.T) {
+	t.Log("Load the origins of a rule from a file or a directory of files")
+
+	dir, _ := ioutil.TempDir("", "cors")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "partners.txt"), []byte("# partners\nHTTPS://Partner.com/\n\nhttps://*.partner.net\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "marketing.csv"), []byte("origin,owner\nhttps://campaign.com,marketing\n# expired\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("https://hidden.com\n"), 0644)
+
+	for _, file := range []string{dir, filepath.Join(dir, "partners.txt")} {
+		cm, err := New(Middleware{Rules: []*host{{OriginsFile: file, Methods: []string{"GET"}, Headers: []string{"*"}}}})
+		if err != nil {
+			t.Errorf("Expected to create middleware but got error: %+v", err)
+			continue
+		}
+
+		cases := map[string]bool{
+			"https://partner.com":     true,
+			"https://www.partner.net": true,
+			"https://campaign.com":    file == dir,
+			"https://hidden.com":      false,
+			"origin":                  false,
+		}
+
+		for origin, allowed := range cases {
+			if _, rule := cm.matchOrigin(origin, "", "/"); (rule != nil) != allowed {
+				t.Errorf("Expected %v loaded from %v to be allowed %v", origin, file, allowed)
+			}
+		}
+
+		if data, _ := json.Marshal(cm); strings.Contains(string(data), "partner.com") {
+			t.Errorf("Expected loaded origins to stay out of the serialized configuration but got %s", data)
+		}
+	}
+
+	if _, err := New(Middleware{Rules: []*host{{OriginsFile: filepath.Join(dir, "missing.txt"), Methods: []string{"GET"}, Headers: []string{"*"}}}}); err == nil {
+		t.Errorf("Expected a missing origins file to fail but got no error")
+	}
+}
+
+// Helper method to create a middleware with the given number of exact origins and dozens of patterns.
+func newLargeMiddleware(origins int) *Middleware {
+	var exact, patterns []string
+	for i := 0; i < origins; i++ {
+		exact = append(exact, fmt.Sprintf("https://partner%d.com", i))
+	}
+
+	for i := 0; i < 50; i++ {
+		patterns = append(patterns, fmt.Sprintf("/https://[a-z]+\\.brand%d\\.com/", i), fmt.Sprintf("https://*.tenant%d.com", i))
+	}
+
+	cm, _ := New(Middleware{Rules: []*host{
+		{Origins: exact, Methods: []string{"GET"}, Headers: []string{"*"}},
+		{Origins: patterns, Methods: []string{"GET"}, Headers: []string{"*"}},
+	}})
+
+	return cm
+}
+
+func TestOriginMatcher(t *testing.T) {
+	t.Log("Match origins through the compiled matcher with the precedence of configured origins")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - name: everyone
+    origins: ["*"]
+    methods: [GET]
+    headers: ["*"]
+  - name: regex
+    origins: ['/https://[a-z]+\.example\.com/']
+    methods: [GET]
+    headers: ["*"]
+  - name: subdomains
+    origins: [https://*.example.com, https://*.eu.example.com:8443]
+    methods: [GET]
+    headers: ["*"]
+  - name: glob
+    origins: ["https://app-?.example.org"]
+    methods: [GET]
+    headers: ["*"]
+  - name: exact
+    origins: [https://www.example.com]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	cases := map[string]string{
+		"https://www.example.com":          "exact",
+		"https://api.example.com":          "regex",
+		"https://a.b.example.com":          "subdomains",
+		"https://a-1.example.com":          "subdomains",
+		"https://x.eu.example.com:8443":    "subdomains",
+		"https://x.eu.example.com":         "subdomains",
+		"https://example.com":              "everyone",
+		"http://api.example.com":           "everyone",
+		"https://app-1.example.org":        "glob",
+		"https://app-10.example.org":       "everyone",
+		"https://api.example.com.evil.com": "everyone",
+	}
+
+	for origin, name := range cases {
+		if _, rule := cm.matchOrigin(origin, "", "/"); rule == nil || rule.Name != name {
+			t.Errorf("Expected %v to match rule %v but got %+v", origin, name, rule)
+		}
+	}
+}
+
+func TestOriginMatcherAllocations(t *testing.T) {
+	t.Log("Match origins without allocating")
+
+	cm := newLargeMiddleware(1000)
+	cases := []struct {
+		origin string
+		regex  bool
+	}{
+		{"https://partner500.com", false},
+		{"https://www.tenant7.com", true},
+		{"https://www.brand7.com", true},
+		{"https://unknown.com", true},
+	}
+
+	for _, c := range cases {
+		// Pattern origins and misses go through the combined regex, which borrows machines from a
+		// sync.Pool that the race detector empties at random.
+		if c.regex && raceEnabled {
+			continue
+		}
+
+		if allocs := testing.AllocsPerRun(100, func() { cm.matchOrigin(c.origin, "api.example.com", "/") }); allocs != 0 {
+			t.Errorf("Expected matching %v not to allocate but it allocated %v times", c.origin, allocs)
+		}
+	}
+}
+
+func benchmarkMatchOrigin(b *testing.B, origins int, origin string) {
+	cm := newLargeMiddleware(origins)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cm.matchOrigin(origin, "api.example.com", "/")
+	}
+}
+
+func BenchmarkMatchOriginExact100(b *testing.B) {
+	benchmarkMatchOrigin(b, 100, "https://partner50.com")
+}
+
+func BenchmarkMatchOriginExact10000(b *testing.B) {
+	benchmarkMatchOrigin(b, 10000, "https://partner5000.com")
+}
+
+func BenchmarkMatchOriginSubdomain(b *testing.B) {
+	benchmarkMatchOrigin(b, 10000, "https://www.tenant49.com")
+}
+
+func BenchmarkMatchOriginRegex(b *testing.B) {
+	benchmarkMatchOrigin(b, 10000, "https://www.brand49.com")
+}
+
+func BenchmarkMatchOriginMiss(b *testing.B) {
+	benchmarkMatchOrigin(b, 10000, "https://www.unknown-partner.com")
+}
+
+func TestDecisionCache(t *testing.T) {
+	t.Log("Reuse the decisions made for identical requests until the deny list is reloaded")
+
+	dir, _ := ioutil.TempDir("", "cors")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "deny.txt")
+	ioutil.WriteFile(file, []byte("# nobody yet\n"), 0644)
+
+	cm, err := New(Middleware{
+		DecisionCache:   &cacheConfig{Size: 10, TTL: 60},
+		DenyOriginsFile: file,
+		Rules:           []*host{{Origins: []string{"*"}, Methods: []string{"GET"}, Headers: []string{"*"}}},
+	})
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	preflight := func() int {
+		req := setupTestRequest(optionsMethod, "http://api.example.com/things", "http://skookum.com")
+		req.Header.Set(requestMethodHeader, "GET")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	counter := func(key string) int64 {
+		if v, ok := metrics.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	hits, misses := counter(cacheHitMetric), counter(cacheMissMetric)
+	for i := 0; i < 3; i++ {
+		if code := preflight(); code != http.StatusOK {
+			t.Errorf("Expected HTTP status %v but it was %v", http.StatusOK, code)
+		}
+	}
+
+	if counter(cacheHitMetric)-hits != 2 || counter(cacheMissMetric)-misses != 1 {
+		t.Errorf("Expected 2 cache hits and 1 miss but got %v and %v", counter(cacheHitMetric)-hits, counter(cacheMissMetric)-misses)
+	}
+
+	ioutil.WriteFile(file, []byte("http://skookum.com\n"), 0644)
+	cm.ReloadDenyOrigins()
+	if code := preflight(); code != http.StatusForbidden {
+		t.Errorf("Expected reloading the deny list to drop cached decisions but got HTTP status %v", code)
+	}
+}
+
+func TestPrivateNetworkAccess(t *testing.T) {
+	t.Log("Answer Private Network Access preflights for the rules allowing them")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://public.com]
+    methods: [GET]
+    headers: ["*"]
+    allow_private_network: true
+  - origins: ["*"]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		origin  string
+		request string
+		code    int
+		allow   string
+		vary    []string
+	}{
+		{"https://public.com", "true", http.StatusOK, "true", []string{originHeader, requestNetworkHeader}},
+		{"https://public.com", "", http.StatusOK, "", []string{originHeader, requestNetworkHeader}},
+		{"https://other.com", "true", http.StatusForbidden, "", []string{originHeader, requestNetworkHeader}},
+		{"https://other.com", "", http.StatusOK, "", []string{originHeader, requestNetworkHeader}},
+	}
+
+	for _, c := range cases {
+		req := setupTestRequest(optionsMethod, "http://intranet.local/", c.origin)
+		req.Header.Set(requestMethodHeader, "GET")
+		if c.request != "" {
+			req.Header.Set(requestNetworkHeader, c.request)
+		}
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != c.code || res.Header().Get(allowNetworkHeader) != c.allow || !reflect.DeepEqual(res.Header()[varyHeader], c.vary) {
+			t.Errorf("Expected %v asking for %q to get %v, %q and Vary %v but got %v, %q and %v", c.origin, c.request, c.code, c.allow, c.vary, res.Code, res.Header().Get(allowNetworkHeader), res.Header()[varyHeader])
+		}
+	}
+}
+
+func TestTimingAllowOrigin(t *testing.T) {
+	t.Log("Send Timing-Allow-Origin on actual responses of the rules setting it")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://echo.com]
+    methods: [GET]
+    headers: ["*"]
+    timing_allow_origin: [origin]
+  - origins: [https://fixed.com]
+    methods: [GET]
+    headers: ["*"]
+    timing_allow_origin: [origin, https://rum.example.com]
+  - origins: [https://everyone.com]
+    methods: [GET]
+    headers: ["*"]
+    timing_allow_origin: ["*"]
+  - origins: ["*"]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	cases := map[string]string{
+		"https://echo.com":     "https://echo.com",
+		"https://fixed.com":    "https://fixed.com, https://rum.example.com",
+		"https://everyone.com": "*",
+		"https://other.com":    "",
+	}
+
+	for origin, timing := range cases {
+		preflight, actual, _ := cm.Explain(origin, "GET", nil, "", "/")
+		if actual.Header.Get(timingHeader) != timing {
+			t.Errorf("Expected Timing-Allow-Origin %q for %v but it was %q", timing, origin, actual.Header.Get(timingHeader))
+		}
+
+		if preflight.Header.Get(timingHeader) != "" {
+			t.Errorf("Expected no Timing-Allow-Origin on preflights but it was %q", preflight.Header.Get(timingHeader))
+		}
+	}
+
+	if _, err := newFromYAML("version: 2\nrules:\n  - {origins: [\"*\"], methods: [GET], headers: [Accept], timing_allow_origin: [echo]}"); err == nil {
+		t.Errorf("Expected an invalid timing_allow_origin entry to fail but got no error")
+	}
+}
+
+func TestIsolationHeaders(t *testing.T) {
+	t.Log("Set the cross-origin isolation headers by path and rule, overriding or merging with upstream")
+
+	cm, err := newFromYAML(`
+version: 2
+defaults:
+  mode: enforce
+isolation:
+  - resource_policy: same-site
+  - paths: [/app]
+    opener_policy: same-origin
+    embedder_policy: require-corp
+  - paths: [/legacy]
+    opener_policy: unsafe-none
+    mode: merge
+rules:
+  - origins: [https://cdn.com]
+    methods: [GET]
+    headers: ["*"]
+    isolation:
+      resource_policy: cross-origin
+  - origins: ["*"]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(openerPolicyHeader, "same-origin-allow-popups")
+		w.Write([]byte("ok"))
+	}))
+
+	cases := []struct {
+		origin   string
+		path     string
+		resource string
+		opener   string
+		embedder string
+	}{
+		{"", "/", "same-site", "same-origin-allow-popups", ""},
+		{"", "/app/index.html", "same-site", "same-origin", "require-corp"},
+		{"", "/legacy", "same-site", "same-origin-allow-popups", ""},
+		{"https://cdn.com", "/app/script.js", "cross-origin", "same-origin", "require-corp"},
+		{"https://other.com", "/app/script.js", "same-site", "same-origin", "require-corp"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://example.com"+c.path, nil)
+		if c.origin != "" {
+			req.Header.Set(originHeader, c.origin)
+		}
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		got := []string{res.Header().Get(resourcePolicyHeader), res.Header().Get(openerPolicyHeader), res.Header().Get(embedderPolicyHeader)}
+		if !reflect.DeepEqual(got, []string{c.resource, c.opener, c.embedder}) {
+			t.Errorf("Expected isolation headers %v, %v and %v for %q on %v but got %v", c.resource, c.opener, c.embedder, c.origin, c.path, got)
+		}
+	}
+
+	invalid := []string{
+		"version: 2\nisolation: [{opener_policy: same-site}]\nrules: [{origins: [\"*\"], methods: [GET], headers: [Accept]}]",
+		"version: 2\nisolation: [{resource_policy: same-site, mode: replace}]\nrules: [{origins: [\"*\"], methods: [GET], headers: [Accept]}]",
+		"version: 2\nrules: [{origins: [\"*\"], methods: [GET], headers: [Accept], isolation: {paths: [/app], resource_policy: same-site}}]",
+	}
+
+	for _, config := range invalid {
+		if _, err := newFromYAML(config); err == nil {
+			t.Errorf("Expected invalid isolation settings to fail but got no error for %v", config)
+		}
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	t.Log("Refuse cross-site requests with the Fetch Metadata policy unless they navigate or come from allowed origins")
+
+	cm, err := newFromYAML(`
+version: 2
+defaults:
+  mode: enforce
+fetch_metadata:
+  paths: [/api]
+deny_origins: [https://blocked.com]
+rules:
+  - origins: [https://partner.com, https://*.partner.com, https://blocked.com]
+    methods: [GET, POST]
+    headers: ["*"]
+  - origins: [https://legacy.partner.com]
+    deny: true
+  - origins: ["*"]
+    methods: [GET, POST]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	h := &Handler{cfg: *cm}
+	cases := []struct {
+		origin string
+		path   string
+		site   string
+		mode   string
+		dest   string
+		reason string
+	}{
+		{"", "/api/things", "", "", "", ""},
+		{"", "/api/things", "cross-site", "no-cors", "image", errorFetchMetadata},
+		{"", "/api/things", "cross-site", "navigate", "document", ""},
+		{"", "/api/things", "cross-site", "navigate", "embed", errorFetchMetadata},
+		{"", "/api/things", "same-site", "no-cors", "image", ""},
+		{"", "/public/logo.png", "cross-site", "no-cors", "image", ""},
+		{"https://partner.com", "/api/things", "cross-site", "cors", "empty", ""},
+		{"https://evil.com", "/api/things", "cross-site", "cors", "empty", errorFetchMetadata},
+		{"null", "/api/things", "cross-site", "cors", "empty", errorFetchMetadata},
+		{"https://app.partner.com", "/api/things", "cross-site", "cors", "empty", ""},
+		{"https://blocked.com", "/api/things", "cross-site", "cors", "empty", errorFetchMetadata},
+		{"https://legacy.partner.com", "/api/things", "cross-site", "cors", "empty", errorFetchMetadata},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://api.example.com"+c.path, nil)
+		for name, value := range map[string]string{originHeader: c.origin, fetchSiteHeader: c.site, fetchModeHeader: c.mode, fetchDestHeader: c.dest} {
+			if value != "" {
+				req.Header.Set(name, value)
+			}
+		}
+
+		if d := h.decide(req); d.Reason != c.reason {
+			t.Errorf("Expected %+v to be decided for %q but got %+v", c, c.reason, d)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	t.Log("Require state-changing requests to come from the same origin or an allowed one")
+
+	cm, err := newFromYAML(`
+version: 2
+defaults:
+  mode: enforce
+csrf:
+  exempt_headers: [X-Api-Key]
+  exempt_paths: [/webhooks]
+deny_origins: [https://blocked.com]
+rules:
+  - origins: [https://partner.com, https://*.partner.com, https://blocked.com]
+    methods: ["*"]
+    headers: ["*"]
+  - origins: [https://legacy.partner.com]
+    deny: true
+  - origins: ["*"]
+    methods: [GET, POST]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	h := &Handler{cfg: *cm}
+	cases := []struct {
+		method string
+		path   string
+		header map[string]string
+		reason string
+	}{
+		{"GET", "/form", nil, ""},
+		{"POST", "/form", nil, errorCSRF},
+		{"DELETE", "/things/1", map[string]string{originHeader: "https://evil.com"}, errorCSRF},
+		{"PUT", "/things/1", map[string]string{originHeader: "https://partner.com"}, ""},
+		{"POST", "/form", map[string]string{refererHeader: "https://partner.com/signup"}, ""},
+		{"POST", "/form", map[string]string{refererHeader: "https://evil.com/attack"}, errorCSRF},
+		{"POST", "/form", map[string]string{refererHeader: "http://api.example.com/form"}, ""},
+		{"POST", "/form", map[string]string{refererHeader: "https://api.example.com/form"}, errorCSRF},
+		{"POST", "/form", map[string]string{refererHeader: "https://api.example.com/form", forwardedProtoHeader: "https"}, ""},
+		{"POST", "/form", map[string]string{originHeader: "https://evil.com"}, errorCSRF},
+		{"POST", "/form", map[string]string{originHeader: "null"}, errorCSRF},
+		{"POST", "/form", map[string]string{originHeader: "https://blocked.com"}, errorCSRF},
+		{"POST", "/form", map[string]string{refererHeader: "https://app.partner.com/signup"}, ""},
+		{"POST", "/form", map[string]string{refererHeader: "https://blocked.com/signup"}, errorCSRF},
+		{"POST", "/form", map[string]string{refererHeader: "https://legacy.partner.com/signup"}, errorCSRF},
+		{"PATCH", "/things/1", map[string]string{"X-Api-Key": "secret"}, ""},
+		{"POST", "/webhooks/github", nil, ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://api.example.com"+c.path, nil)
+		for name, value := range c.header {
+			req.Header.Set(name, value)
+		}
+
+		if d := h.decide(req); d.Reason != c.reason {
+			t.Errorf("Expected %v %v with %v to be decided for %q but got %+v", c.method, c.path, c.header, c.reason, d)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Log("Check the origin of WebSocket handshakes before they reach the upstream")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://app.com]
+    methods: [GET]
+    headers: ["*"]
+  - origins: [https://widgets.com]
+    methods: [GET]
+    headers: ["*"]
+    websocket: false
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	reached := false
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	cases := []struct {
+		origin    string
+		websocket bool
+		reached   bool
+	}{
+		{"https://app.com", true, true},
+		{"https://widgets.com", true, false},
+		{"https://widgets.com", false, true},
+		{"https://evil.com", true, false},
+		{"http://api.example.com", true, true},
+	}
+
+	for _, c := range cases {
+		req := setupTestRequest("GET", "http://api.example.com/socket", c.origin)
+		if c.websocket {
+			req.Header.Set(upgradeHeader, "WebSocket")
+			req.Header.Set(connectionHeader, "keep-alive, Upgrade")
+		}
+
+		reached = false
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if reached != c.reached {
+			t.Errorf("Expected %v handshake %v to reach the upstream %v but got HTTP status %v", c.origin, c.websocket, c.reached, res.Code)
+		}
+	}
+
+	req := setupTestRequest("GET", "http://api.example.com/socket", "https://widgets.com")
+	req.Header.Set(upgradeHeader, "websocket")
+	req.Header.Set(connectionHeader, "Upgrade")
+	if d := (&Handler{cfg: *cm}).decide(req); d.Reason != errorWebSocket {
+		t.Errorf("Expected handshake to be denied with %v but got %+v", errorWebSocket, d)
+	}
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+	t.Log("Strip, merge or keep the Access-Control headers set upstream")
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(allowOriginHeader, "*")
+		w.Header().Add(exposeHeader, "X-Upstream")
+		w.Header().Set(maxAgeHeader, "600")
+		w.Write([]byte("ok"))
+	})
+
+	cases := []struct {
+		mode   string
+		origin string
+		expose string
+		maxAge string
+	}{
+		{"", "https://app.com", "X-Total-Count", ""},
+		{upstreamStrip, "https://app.com", "X-Total-Count", ""},
+		{upstreamMerge, "https://app.com", "X-Total-Count, X-Upstream", "600"},
+		{upstreamWins, "*", "X-Upstream", "600"},
+	}
+
+	for _, c := range cases {
+		cm, err := newFromYAML(fmt.Sprintf(`
+version: 2
+defaults:
+  upstream_headers: %q
+rules:
+  - origins: [https://app.com]
+    methods: [GET]
+    headers: ["*"]
+    expose_headers: [X-Total-Count]
+`, c.mode))
+		if err != nil {
+			t.Errorf("Expected to create middleware but got error: %+v", err)
+			continue
+		}
+
+		handler, _ := cm.NewHandler(upstream)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, setupTestRequest("GET", "http://api.example.com/", "https://app.com"))
+
+		if v := res.Header().Get(allowOriginHeader); v != c.origin {
+			t.Errorf("Expected %q mode to send origin %v but got %v", c.mode, c.origin, v)
+		}
+
+		if v := strings.Join(res.Header()[exposeHeader], ", "); v != c.expose {
+			t.Errorf("Expected %q mode to expose %v but got %v", c.mode, c.expose, v)
+		}
+
+		if v := res.Header().Get(maxAgeHeader); v != c.maxAge {
+			t.Errorf("Expected %q mode to send max age %q but got %q", c.mode, c.maxAge, v)
+		}
+	}
+
+	if _, err := newFromYAML(`
+version: 2
+defaults:
+  upstream_headers: replace
+rules:
+  - origins: ["*"]
+    methods: ["*"]
+    headers: ["*"]
+`); err == nil {
+		t.Errorf("Expected an unknown upstream_headers value to be rejected but got no error")
+	}
+}
+
+// Records a response that can be flushed, hijacked and notifies when the client goes away.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+	closed   chan bool
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func (r *hijackRecorder) CloseNotify() <-chan bool {
+	return r.closed
+}
+
+func TestUpstreamWriterInterfaces(t *testing.T) {
+	t.Log("Preserve Flusher, Hijacker and CloseNotifier on the response passed upstream")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://app.com]
+    methods: [GET]
+    headers: ["*"]
+    expose_headers: [X-Client-*]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder(), closed: make(chan bool)}
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, ok := w.(http.CloseNotifier); !ok || n.CloseNotify() != rec.closed {
+			t.Errorf("Expected the upstream response to pass on CloseNotify but got %T", w)
+		}
+
+		if f, ok := w.(http.Flusher); !ok {
+			t.Errorf("Expected the upstream response to be a Flusher but got %T", w)
+		} else {
+			f.Flush()
+		}
+
+		if h, ok := w.(http.Hijacker); !ok {
+			t.Errorf("Expected the upstream response to be a Hijacker but got %T", w)
+		} else if _, _, err := h.Hijack(); err != nil {
+			t.Errorf("Expected to hijack the connection but got error: %+v", err)
+		}
+	}))
+
+	handler.ServeHTTP(rec, setupTestRequest("GET", "http://api.example.com/", "https://app.com"))
+	if !rec.Flushed || !rec.hijacked {
+		t.Errorf("Expected the upstream to flush and hijack the response but got flushed %v and hijacked %v", rec.Flushed, rec.hijacked)
+	}
+
+	if v := rec.Header().Get(allowOriginHeader); v != "https://app.com" {
+		t.Errorf("Expected Origin header https://app.com but got %v", v)
+	}
+
+	handler, _ = cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := w.(http.Hijacker).Hijack(); err == nil || err.Error() != errorHijack {
+			t.Errorf("Expected %v from a response that can't be hijacked but got %+v", errorHijack, err)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), setupTestRequest("GET", "http://api.example.com/", "https://app.com"))
+}
+
+func TestMethodOverride(t *testing.T) {
+	t.Log("Check the methods tunnelled through override headers against the origin's rule")
+
+	cm, err := newFromYAML(`
+version: 2
+method_override:
+  headers: [X-HTTP-Method-Override, X-Tunnel-Method]
+rules:
+  - origins: [https://legacy.com]
+    methods: [GET, POST, PATCH]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	h := &Handler{cfg: *cm}
+	cases := []struct {
+		header  string
+		method  string
+		allowed bool
+	}{
+		{"", "", true},
+		{"X-HTTP-Method-Override", "PATCH", true},
+		{"X-HTTP-Method-Override", "delete", false},
+		{"X-Tunnel-Method", "DELETE", false},
+		{"X-Method-Override", "DELETE", true},
+	}
+
+	for _, c := range cases {
+		req := setupTestRequest("POST", "http://api.example.com/items/1", "https://legacy.com")
+		if c.header != "" {
+			req.Header.Set(c.header, c.method)
+		}
+
+		d := h.decide(req)
+		if d.Allowed != c.allowed {
+			t.Errorf("Expected POST overridden with %v: %v to be allowed %v but got %+v", c.header, c.method, c.allowed, d)
+		}
+
+		if !c.allowed && d.Reason != errorOverride {
+			t.Errorf("Expected denial reason %v but got %v", errorOverride, d.Reason)
+		}
+	}
+
+	cm.MethodOverride.Headers = nil
+	req := setupTestRequest("POST", "http://api.example.com/items/1", "https://legacy.com")
+	req.Header.Set("X-HTTP-Method", "DELETE")
+	if d := (&Handler{cfg: *cm}).decide(req); d.Allowed || d.Method != "DELETE" {
+		t.Errorf("Expected the default override headers to be checked but got %+v", d)
+	}
+}
+
+func TestRequireHeaders(t *testing.T) {
+	t.Log("Deny requests from a rule's origins that lack its required headers")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://partner.com]
+    methods: [GET, POST]
+    headers: [Content-Type, X-Partner-Key]
+    require_headers: [x-partner-key]
+  - origins: [https://app.com]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	h := &Handler{cfg: *cm}
+	cases := []struct {
+		method  string
+		origin  string
+		header  string
+		value   string
+		allowed bool
+	}{
+		{"POST", "https://partner.com", "X-Partner-Key", "secret", true},
+		{"POST", "https://partner.com", "Content-Type", "application/json", false},
+		{"OPTIONS", "https://partner.com", requestHeadersHeader, "content-type, x-partner-key", true},
+		{"OPTIONS", "https://partner.com", requestHeadersHeader, "Content-Type", false},
+		{"GET", "https://app.com", "Accept", "*/*", true},
+	}
+
+	for _, c := range cases {
+		req := setupTestRequest(c.method, "http://api.example.com/", c.origin)
+		req.Header.Set(c.header, c.value)
+		if c.method == "OPTIONS" {
+			req.Header.Set(requestMethodHeader, "POST")
+		}
+
+		d := h.decide(req)
+		if d.Allowed != c.allowed {
+			t.Errorf("Expected %v from %v with %v: %v to be allowed %v but got %+v", c.method, c.origin, c.header, c.value, c.allowed, d)
+		}
+
+		if !c.allowed && d.Reason != errorMissingHeader {
+			t.Errorf("Expected denial reason %v but got %v", errorMissingHeader, d.Reason)
+		}
+	}
+
+	cm.Rules[0].effective.Headers = []string{"Content-Type"}
+	if warnings := cm.Lint(); len(warnings) != 1 || !strings.Contains(warnings[0], "X-Partner-Key") {
+		t.Errorf("Expected a warning about the required header that isn't allowed but got %v", warnings)
+	}
+}
+
+func TestHeaderValues(t *testing.T) {
+	t.Log("Deny actual requests whose header values break the rule's constraints")
+
+	cm, err := newFromYAML(`
+version: 2
+decision_cache: {}
+rules:
+  - origins: [https://app.com]
+    methods: [GET, POST]
+    headers: ["*"]
+    header_values:
+      - header: content-type
+        values: [application/json, '/application/[a-z.]+\+json/']
+      - header: X-Client-*
+        max_length: 8
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		header    string
+		value     string
+		violation string
+	}{
+		{"Content-Type", "application/json; charset=utf-8", ""},
+		{"Content-Type", "application/vnd.api+json", ""},
+		{"Content-Type", "text/plain", "Content-Type must be one of application/json, /application/[a-z.]+\\+json/"},
+		{"X-Client-Id", "abc", ""},
+		{"X-Client-Id", "abcdefghi", "X-Client-Id is longer than 8"},
+		{"X-Other", "abcdefghi", ""},
+	}
+
+	for _, c := range cases {
+		req := setupTestRequest("POST", "http://api.example.com/", "https://app.com")
+		req.Header.Set(c.header, c.value)
+
+		d := (&Handler{cfg: *cm}).decide(req)
+		if c.violation == "" && !d.Allowed {
+			t.Errorf("Expected %v: %v to be allowed but got %+v", c.header, c.value, d)
+		} else if c.violation != "" && (d.Reason != errorHeaderValue || !strings.HasSuffix(d.Match, c.violation)) {
+			t.Errorf("Expected %v: %v to be denied with %v because %v but got %+v", c.header, c.value, errorHeaderValue, c.violation, d)
+		}
 
-	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
-	handler, _ := cors.NewHandler(next)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if (res.Code == http.StatusForbidden) != (c.violation != "") {
+			t.Errorf("Expected %v: %v to be denied %v through the decision cache but got HTTP status %v", c.header, c.value, c.violation != "", res.Code)
+		}
+	}
 
-	return httptest.NewServer(handler)
+	req := setupTestRequest("OPTIONS", "http://api.example.com/", "https://app.com")
+	req.Header.Set(requestMethodHeader, "POST")
+	req.Header.Set("Content-Type", "text/plain")
+	if d := (&Handler{cfg: *cm}).decide(req); !d.Allowed {
+		t.Errorf("Expected preflights to be left to the actual request but got %+v", d)
+	}
+
+	if v := metrics.Get(deniedMetric + "bad_header_value"); v == nil || v.String() != "2" {
+		t.Errorf("Expected the violations to be counted under one denied.bad_header_value metric but it was %v", v)
+	}
+
+	if _, actual, _ := cm.Explain("https://app.com", "POST", []string{"Content-Type", "X-Client-Id"}, "", "/"); !actual.Allowed {
+		t.Errorf("Expected explain to leave headers without a value unchecked but got %+v", actual)
+	}
+
+	if _, actual, _ := cm.Explain("https://app.com", "POST", []string{"Content-Type: text/plain"}, "", "/"); actual.Reason != errorHeaderValue {
+		t.Errorf("Expected explain to check the values it is given but got %+v", actual)
+	}
+
+	if _, actual, _ := cm.Explain("https://app.com", "POST", []string{"Content-Type: " + placeholderValue}, "", "/"); actual.Reason != errorHeaderValue {
+		t.Errorf("Expected explain to check a given value even when it is %q but got %+v", placeholderValue, actual)
+	}
+
+	if _, err := newFromYAML(`
+version: 2
+rules:
+  - origins: ["*"]
+    methods: ["*"]
+    headers: ["*"]
+    header_values:
+      - header: X-Trace-Id
+`); err == nil {
+		t.Errorf("Expected a header_values entry without values or max_length to be rejected but got no error")
+	}
 }
 
-func setupTestRequest(method string, url string, origin string) *http.Request {
-	req, _ := http.NewRequest(method, url, nil)
-	req.Header.Add("Origin", origin)
+func TestExceptMethodsIgnoreCase(t *testing.T) {
+	t.Log("Method exclusions apply whatever their case, and to OPTIONS as well")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: ["*"]
+    methods: ["*"]
+    except_methods: [delete, options]
+    headers: ["*"]
+  - origins: [http://api.com]
+    methods: [get, post]
+    remove_methods: [post]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
 
-	return req
+	cases := []struct {
+		origin  string
+		method  string
+		allowed bool
+	}{
+		{"http://app.com", "DELETE", false},
+		{"http://app.com", "OPTIONS", false},
+		{"http://app.com", "PUT", true},
+		{"http://api.com", "GET", true},
+		{"http://api.com", "POST", false},
+	}
+
+	for _, c := range cases {
+		d := (&Handler{cfg: *cm}).decide(setupTestRequest(c.method, "http://api.example.com/", c.origin))
+		if d.Allowed != c.allowed {
+			t.Errorf("Expected %v from %v to be allowed %v but got %+v", c.method, c.origin, c.allowed, d)
+		}
+	}
 }
 
-func TestSpecIsOK(t *testing.T) {
-	t.Log("Add CORS Middleware spec to Vulcan registry")
+func TestAllowOriginFuncAfterNew(t *testing.T) {
+	t.Log("Consult AllowOriginFunc when it is set after the middleware is created")
 
-	err := plugin.NewRegistry().AddSpec(GetSpec())
+	cm, err := New(Middleware{
+		Rules: []*host{{Origins: []string{"http://skookum.com"}, Methods: []string{"GET"}, Headers: []string{"Accept"}}},
+	})
 	if err != nil {
-		t.Errorf("Expected to be able to add spec but got error %+v", err)
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	calls := 0
+	cm.AllowOriginFunc = func(r *http.Request, origin string) (Policy, bool) {
+		calls++
+		return Policy{Methods: []string{"GET"}, Headers: []string{"*"}}, origin == "https://acme.example.com"
+	}
+
+	if d := (&Handler{cfg: *cm}).decide(setupTestRequest("GET", "http://api.example.com/", "https://acme.example.com")); !d.Allowed {
+		t.Errorf("Expected tenant origin to be allowed without a cache but got %+v", d)
+	}
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 2; i++ {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, setupTestRequest("GET", "http://api.example.com/", "https://acme.example.com"))
+		if res.Code != http.StatusOK {
+			t.Errorf("Expected HTTP status %v but it was %v", http.StatusOK, res.Code)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("Expected AllowOriginFunc to be called once per cache miss, 2 times, but it was called %v times", calls)
 	}
 }
 
-func TestNew(t *testing.T) {
-	t.Log("Creating CORS Middleware with New method")
+func TestSerializableConfig(t *testing.T) {
+	t.Log("Encode configurations without their runtime hooks")
 
-	config, err := readConfigFile()
+	cm, err := New(Middleware{
+		Rules: []*host{{Origins: []string{"http://skookum.com"}, Methods: []string{"GET"}, Headers: []string{"Accept"}}},
+		AllowOriginFunc: func(r *http.Request, origin string) (Policy, bool) {
+			return Policy{}, false
+		},
+	})
 	if err != nil {
-		t.Errorf("Received error while processing config file: %+v", err)
+		t.Errorf("Expected to create middleware but got error: %+v", err)
 	}
 
-	cm, err := New(config)
+	plain := reflect.TypeOf(serializable(cm))
+	if _, ok := plain.FieldByName("AllowOriginFunc"); ok {
+		t.Errorf("Expected AllowOriginFunc to be left out but got %v", plain)
+	}
+
+	for _, format := range []string{yamlFormat, jsonFormat, tomlFormat} {
+		data, err := marshalConfig(format, serializable(cm))
+		if err != nil {
+			t.Errorf("Expected to encode %v but got error: %+v", format, err)
+		}
+
+		var decoded Middleware
+		if err := unmarshalConfig(format, data, &decoded); err != nil || len(decoded.Rules) != 1 {
+			t.Errorf("Expected %v to decode to one rule but got %+v and error %+v", format, decoded.Rules, err)
+		}
+	}
+}
+
+func TestUpstreamWithoutWrite(t *testing.T) {
+	t.Log("Finish the CORS headers of upstreams that set headers and return without writing")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://app.com]
+    methods: [GET]
+    headers: ["*"]
+    expose_headers: [X-Client-*]
+    isolation:
+      resource_policy: same-site
+`)
 	if err != nil {
 		t.Errorf("Expected to create middleware but got error: %+v", err)
 	}
 
-	if cm == nil {
-		t.Errorf("Expected a CORS Middleware instance but got %+v", cm)
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(allowOriginHeader, "*")
+		w.Header().Set("X-Client-Id", "42")
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res, err := (&http.Client{}).Do(setupTestRequest("GET", server.URL, "https://app.com"))
+	if err != nil {
+		t.Errorf("Error while processing request: %+v", err)
+		return
 	}
+	res.Body.Close()
 
-	if cm.String() == "" {
-		t.Errorf("Expected middleware string %+v but got empty string", cm)
+	if v := res.Header.Get(allowOriginHeader); v != "https://app.com" {
+		t.Errorf("Expected Origin header https://app.com but got %v", v)
 	}
 
-	handler, err := cm.NewHandler(nil)
+	if v := res.Header.Get(exposeHeader); v != "X-Client-Id" {
+		t.Errorf("Expected expose header X-Client-Id but got %v", v)
+	}
+
+	if v := res.Header.Get(resourcePolicyHeader); v != "same-site" {
+		t.Errorf("Expected %v same-site but got %v", resourcePolicyHeader, v)
+	}
+}
+
+func TestExplainRequiredHeaders(t *testing.T) {
+	t.Log("Explain requests to rules that require headers, with and without their values")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://partner.com]
+    methods: [GET, POST]
+    headers: [Content-Type, X-Partner-Key]
+    require_headers: [X-Partner-Key]
+`)
 	if err != nil {
-		t.Errorf("Expected to received a handler but got error: %+v", err)
+		t.Errorf("Expected to create middleware but got error: %+v", err)
 	}
 
-	if handler == nil {
-		t.Errorf("Expected a CORS Handler instance but got %+v", handler)
+	for _, headers := range [][]string{{"X-Partner-Key"}, {"x-partner-key: secret", "Content-Type: application/json"}} {
+		preflight, actual, _ := cm.Explain("https://partner.com", "POST", headers, "", "/")
+		if !preflight.Allowed || !actual.Allowed {
+			t.Errorf("Expected requests with %v to be allowed but got %+v and %+v", headers, preflight, actual)
+		}
+	}
+
+	preflight, actual, _ := cm.Explain("https://partner.com", "POST", []string{"Content-Type: application/json"}, "", "/")
+	if preflight.Reason != errorMissingHeader || actual.Reason != errorMissingHeader {
+		t.Errorf("Expected requests without X-Partner-Key to be denied with %v but got %v and %v", errorMissingHeader, preflight.Reason, actual.Reason)
 	}
 }
 
-func TestNewInvalid(t *testing.T) {
-	t.Log("Creating CORS Middleware with invalid data")
+func TestPolicyMethodsIgnoreCase(t *testing.T) {
+	t.Log("Match the methods AllowOriginFunc allows without regard to case")
 
-	_, err := New(map[string]*host{})
-	if err == nil {
-		t.Errorf("Expected to receive an error but got %+v", err)
+	cm, err := New(Middleware{
+		Rules: []*host{{Origins: []string{"http://skookum.com"}, Methods: []string{"GET"}, Headers: []string{"Accept"}}},
+		AllowOriginFunc: func(r *http.Request, origin string) (Policy, bool) {
+			return Policy{Methods: []string{"get", "Put"}, Headers: []string{"Accept"}}, true
+		},
+	})
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	for _, method := range []string{"GET", "PUT"} {
+		if _, actual, _ := cm.Explain("https://acme.example.com", method, nil, "", "/"); !actual.Allowed {
+			t.Errorf("Expected %v to be allowed by %v but got %+v", method, originFuncRule, actual)
+		}
+	}
+}
+
+func TestDecisionCacheScheme(t *testing.T) {
+	t.Log("Keep cached decisions apart for requests over different schemes")
+
+	cm, err := newFromYAML(`
+version: 2
+decision_cache:
+  size: 10
+rules:
+  - origins: [https://app.com]
+    methods: [GET]
+    headers: ["*"]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		proto string
+		code  int
+	}{
+		{"https", http.StatusOK},
+		{"http", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		req := setupTestRequest("GET", "http://api.example.com/socket", "https://api.example.com")
+		req.Header.Set(upgradeHeader, "websocket")
+		req.Header.Set(connectionHeader, "Upgrade")
+		req.Header.Set(forwardedProtoHeader, c.proto)
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != c.code {
+			t.Errorf("Expected %v handshake to get HTTP status %v but it was %v", c.proto, c.code, res.Code)
+		}
+	}
+}
+
+func TestDeniedLogsMatch(t *testing.T) {
+	t.Log("Log the constraint a denied request breaks along with the reason")
+
+	cm, err := newFromYAML(`
+version: 2
+rules:
+  - origins: [https://app.com]
+    methods: [POST]
+    headers: ["*"]
+    header_values:
+      - header: Content-Type
+        values: [application/json]
+`)
+	if err != nil {
+		t.Errorf("Expected to create middleware but got error: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := setupTestRequest("POST", "http://api.example.com/", "https://app.com")
+	req.Header.Set("Content-Type", "text/plain")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := "Content-Type must be one of application/json"
+	if line := strings.SplitN(buf.String(), "\n", 2)[0]; !strings.Contains(line, errorHeaderValue) || !strings.Contains(line, expected) {
+		t.Errorf("Expected the denial to be logged with %v and %v but got %q", errorHeaderValue, expected, line)
 	}
 }
 
@@ -99,7 +2063,7 @@ func TestFromOther(t *testing.T) {
 		t.Errorf("Received error while processing config file: %+v", err)
 	}
 
-	cm, err := New(config)
+	cm, err := New(Middleware{AllowedOrigins: config})
 	if err != nil {
 		t.Errorf("Expected to create middleware but got error: %+v", err)
 	}
@@ -135,9 +2099,9 @@ func TestFromCli(t *testing.T) {
 			t.Errorf("Expected CORS Middleware instance but got %+v", cm)
 		}
 
-		originCount := len((cm.(*Middleware)).AllowedOrigins)
-		if originCount != 5 {
-			t.Errorf("Expected 5 origins but got %v", originCount)
+		ruleCount := len((cm.(*Middleware)).Rules)
+		if ruleCount != 6 {
+			t.Errorf("Expected 6 rules but got %v", ruleCount)
 		}
 	}
 
@@ -148,6 +2112,125 @@ func TestFromCli(t *testing.T) {
 	}
 }
 
+func TestFromCliInline(t *testing.T) {
+	t.Log("Create CORS Middleware from inline command line flags")
+
+	var config Middleware
+	yaml.Unmarshal([]byte(`
+version: 2
+rules:
+  - origins: [http://a.com, http://b.com]
+    methods: [GET, PATCH]
+    headers: [accept, x-custom]
+    expose_headers: [x-total-count]
+    credentials: true
+    max_age: 600
+`), &config)
+	expected, _ := New(config)
+
+	app := cli.NewApp()
+	executed := false
+	app.Action = func(ctx *cli.Context) {
+		executed = true
+		cm, err := FromCli(ctx)
+		if err != nil {
+			t.Errorf("Expected to create middleware but got error: %+v", err)
+		}
+
+		if !reflect.DeepEqual(cm, expected) {
+			t.Errorf("Expected middleware %v but got %v", expected, cm)
+		}
+	}
+
+	app.Flags = CliFlags()
+	app.Run([]string{"CORS Middleware Test", "--origin=http://a.com", "--origin=http://b.com",
+		"--methods=GET,PATCH", "--headers=accept", "--headers=x-custom", "--expose=x-total-count",
+		"--max-age=600", "--credentials"})
+	if !executed {
+		t.Errorf("Expected CLI app to run but it did not.")
+	}
+}
+
+func TestFromCliWithoutOrigins(t *testing.T) {
+	t.Log("Refuse to create CORS Middleware without a file or inline origins")
+
+	app := cli.NewApp()
+	app.Action = func(ctx *cli.Context) {
+		if _, err := FromCli(ctx); err == nil {
+			t.Errorf("Expected to receive an error but got %+v", err)
+		}
+	}
+
+	app.Flags = CliFlags()
+	app.Run([]string{"CORS Middleware Test", "--methods=GET"})
+}
+
+func TestConfigFormats(t *testing.T) {
+	t.Log("Read the same configuration from YAML, JSON and TOML files")
+
+	expected, err := readConfig("test.yml")
+	if err != nil {
+		t.Errorf("Received error while processing config file: %+v", err)
+	}
+
+	for _, file := range []string{"test.json", "test.toml"} {
+		config, err := readConfig(file)
+		if err != nil {
+			t.Errorf("Received error while processing %v: %+v", file, err)
+		}
+
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("Expected %v to equal the YAML configuration but got %v", file, config)
+		}
+	}
+}
+
+func TestConfigFormatFromContent(t *testing.T) {
+	t.Log("Detect the configuration format from the content when there is no extension")
+
+	formats := map[string]string{
+		"# partners\n{\"*\": {}}": jsonFormat,
+		"[\"*\"]\nmethods = []":   tomlFormat,
+		"\"*\":\n  methods: []":   yamlFormat,
+	}
+
+	for content, expected := range formats {
+		format := configFormat("cors", []byte(content))
+		if format != expected {
+			t.Errorf("Expected format %v but got %v", expected, format)
+		}
+	}
+}
+
+func TestSerializedMaxAge(t *testing.T) {
+	t.Log("Keep max age when vulcand serializes the middleware")
+
+	config, _ := readConfigFile()
+	cm, _ := New(Middleware{AllowedOrigins: config})
+
+	data, err := json.Marshal(cm)
+	if err != nil {
+		t.Errorf("Expected to serialize middleware but got error: %+v", err)
+	}
+
+	var stored Middleware
+	json.Unmarshal(data, &stored)
+	other, err := FromOther(stored)
+	if err != nil {
+		t.Errorf("Expected to create other middleware but got error: %+v", err)
+	}
+
+	maxAge := other.(*Middleware).maxAgeForOrigin("http://skookum.com", "", "/")
+	if maxAge != 86500 {
+		t.Errorf("Expected max age %v but got %v", 86500, maxAge)
+	}
+
+	json.Unmarshal([]byte(`{"AllowedOrigins": {"*": {"Methods": ["GET"], "Headers": ["Accept"], "MaxAge": 600}}}`), &stored)
+	if stored.AllowedOrigins[allToken].MaxAge != 600 {
+		t.Errorf("Expected legacy max age %v but got %v", 600, stored.AllowedOrigins[allToken].MaxAge)
+	}
+}
+
 func TestMaxAge(t *testing.T) {
 	t.Log("Max Age header.")
 
@@ -198,6 +2281,39 @@ func TestDefaultMaxAge(t *testing.T) {
 	}
 }
 
+func TestCredentialsAndExposeHeaders(t *testing.T) {
+	t.Log("Allow credentials and expose headers when configured")
+
+	origin := "http://credentials.com"
+	server := setupTestServer(origin)
+	defer server.Close()
+
+	req := setupTestRequest("GET", server.URL, origin)
+	res, err := (&http.Client{}).Do(req)
+
+	if err != nil {
+		t.Errorf("Error while processing request: %+v", err)
+	}
+
+	resCredentials := res.Header.Get(credentialsHeader)
+	if resCredentials != "true" {
+		t.Errorf("Expected credentials header %v but it was %v", "true", resCredentials)
+	}
+
+	resExpose := res.Header.Get(exposeHeader)
+	if resExpose != "X-Total-Count" {
+		t.Errorf("Expected expose header %v but it was %v", "X-Total-Count", resExpose)
+	}
+
+	req = setupTestRequest("OPTIONS", server.URL, origin)
+	res, _ = (&http.Client{}).Do(req)
+
+	resExpose = res.Header.Get(exposeHeader)
+	if resExpose != "" {
+		t.Errorf("Expected no expose header on preflight but it was %v", resExpose)
+	}
+}
+
 func TestAllowAllOrigins(t *testing.T) {
 	t.Log("Allow all origins when '*' is provided.")
 
@@ -273,6 +2389,70 @@ func TestAllowRegexOrigin(t *testing.T) {
 	}
 }
 
+func TestDenyMissingOrigin(t *testing.T) {
+	t.Log("Deny requests without an Origin in strict mode")
+
+	server := setupTestServer("*")
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	res, err := (&http.Client{}).Do(req)
+
+	if err != nil {
+		t.Errorf("Error while processing request: %+v", err)
+	}
+
+	code := res.StatusCode
+	if code != http.StatusForbidden {
+		t.Errorf("Expected HTTP status %v but it was %v", http.StatusForbidden, code)
+	}
+}
+
+func TestEnforceModeMissingOrigin(t *testing.T) {
+	t.Log("Pass requests without an Origin through in enforce mode")
+
+	config, _ := readConfig("test_v2.yml")
+	cm, _ := New(config)
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, method := range []string{"GET", "OPTIONS"} {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/", nil)
+		handler.ServeHTTP(res, req)
+
+		if res.Code != http.StatusNoContent {
+			t.Errorf("Expected HTTP status %v for %v but it was %v", http.StatusNoContent, method, res.Code)
+		}
+
+		if res.Header().Get(allowOriginHeader) != "" {
+			t.Errorf("Expected no Origin header but it was %v", res.Header().Get(allowOriginHeader))
+		}
+	}
+}
+
+func TestReportMode(t *testing.T) {
+	t.Log("Let denied requests through in report mode")
+
+	config, _ := readConfigFile()
+	cm, _ := New(Middleware{Defaults: defaults{Mode: reportMode, Log: logNone}, AllowedOrigins: map[string]*host{"http://skookum.com": config["http://skookum.com"]}})
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, setupTestRequest("GET", "/", "http://notallowed.com"))
+
+	if res.Code != http.StatusNoContent {
+		t.Errorf("Expected HTTP status %v but it was %v", http.StatusNoContent, res.Code)
+	}
+
+	if res.Header().Get(allowOriginHeader) != "" {
+		t.Errorf("Expected no Origin header but it was %v", res.Header().Get(allowOriginHeader))
+	}
+}
+
 func TestDenySpecificOrigin(t *testing.T) {
 	t.Log("Deny specific origin when not configured for access")
 
@@ -519,3 +2699,78 @@ func TestDenySpecificHeader(t *testing.T) {
 		t.Errorf("Expected HTTP status %v but it was %v", http.StatusForbidden, code)
 	}
 }
+
+func TestDeniedNotPassedUpstream(t *testing.T) {
+	t.Log("Denied requests are answered with 403 and never reach the upstream")
+
+	data, _ := readConfigFile()
+	cm, _ := New(Middleware{AllowedOrigins: map[string]*host{"http://skookum.com": data["http://skookum.com"]}})
+
+	reached := false
+	handler, _ := cm.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, setupTestRequest("GET", "http://api.example.com/", "http://notallowed.com"))
+	if res.Code != http.StatusForbidden || reached {
+		t.Errorf("Expected HTTP status %v without reaching the upstream but got %v and reached %v", http.StatusForbidden, res.Code, reached)
+	}
+}
+
+func TestExplainAllowed(t *testing.T) {
+	t.Log("Explain a request that is allowed")
+
+	config, _ := readConfigFile()
+	cm, _ := New(Middleware{AllowedOrigins: config})
+
+	origin := "http://allmethods.com"
+	preflight, actual, err := cm.Explain(origin, "PUT", []string{"Accept"}, "", "/api")
+	if err != nil {
+		t.Errorf("Expected to explain request but got error: %+v", err)
+	}
+
+	for _, d := range []*Decision{preflight, actual} {
+		if !d.Allowed {
+			t.Errorf("Expected request to be allowed but it was denied: %v", d.Reason)
+		}
+
+		if d.Rule != origin {
+			t.Errorf("Expected rule %v but it was %v", origin, d.Rule)
+		}
+
+		if d.Header.Get(allowMethodsHeader) != "PUT" {
+			t.Errorf("Expected method header %v but it was %v", "PUT", d.Header.Get(allowMethodsHeader))
+		}
+	}
+
+	if preflight.Header.Get(maxAgeHeader) != "86400" {
+		t.Errorf("Expected preflight Max Age header %v but it was %v", "86400", preflight.Header.Get(maxAgeHeader))
+	}
+
+	if actual.Header.Get(maxAgeHeader) != "" {
+		t.Errorf("Expected no Max Age header on actual request but it was %v", actual.Header.Get(maxAgeHeader))
+	}
+}
+
+func TestExplainDenied(t *testing.T) {
+	t.Log("Explain a request that is denied")
+
+	config, _ := readConfigFile()
+	cm, _ := New(Middleware{AllowedOrigins: config})
+
+	preflight, _, _ := cm.Explain("http://skookum.org", "POST", nil, "", "/")
+	if preflight.Allowed {
+		t.Errorf("Expected preflight to be denied but it was allowed")
+	}
+
+	if preflight.Rule != allToken || preflight.Reason != errorBadMethod {
+		t.Errorf("Expected rule %v and reason %v but got %v and %v", allToken, errorBadMethod, preflight.Rule, preflight.Reason)
+	}
+
+	var out bytes.Buffer
+	writeDecision(&out, "Preflight", preflight)
+	if !strings.Contains(out.String(), "Preflight: denied (bad method)") {
+		t.Errorf("Expected explanation to report the denial but got %v", out.String())
+	}
+}
@@ -0,0 +1,120 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Methods that change state, which CSRF protection applies to.
+var unsafeMethods = []string{"POST", "PUT", "PATCH", "DELETE"}
+
+// csrf struct configures the protection of state-changing requests against cross-site request forgery.
+type csrf struct {
+	// Requests carrying any of ExemptHeaders, or to one of ExemptPaths, are not checked, for
+	// non-browser clients.
+	ExemptHeaders []string `yaml:"exempt_headers,omitempty" json:"exempt_headers,omitempty" toml:"exempt_headers,omitempty"`
+	ExemptPaths   []string `yaml:"exempt_paths,omitempty" json:"exempt_paths,omitempty" toml:"exempt_paths,omitempty"`
+}
+
+// Checks whether the request is exempt from CSRF protection.
+func (c *csrf) exempt(r *http.Request) bool {
+	for _, name := range c.ExemptHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+
+	_, specificity := bestPath(c.ExemptPaths, r.URL.Path)
+	return specificity >= 0
+}
+
+// Checks that a state-changing request comes from the same origin or an origin the rules allow.
+// The origin is taken from Origin, or from Referer when browsers leave Origin out.
+func (h *Handler) checkCSRF(d *Decision, r *http.Request) bool {
+	policy := h.cfg.CSRF
+	if policy == nil || !h.isUnsafe(r) || policy.exempt(r) {
+		return true
+	}
+
+	source := d.Origin
+	if source == "" {
+		source = refererOrigin(r)
+	}
+
+	switch {
+	case source == "":
+		d.Match = "request has neither Origin nor Referer"
+	case source == requestOrigin(r):
+		return true
+	case h.isAllowlisted(source, r):
+		return true
+	default:
+		d.Match = fmt.Sprintf("origin %q is neither same-origin nor allowed", source)
+	}
+
+	d.Rule = csrfRule
+	d.deny(errorCSRF)
+	return false
+}
+
+// Checks whether the request changes state, going by the overridden method as well when overrides are checked.
+func (h *Handler) isUnsafe(r *http.Request) bool {
+	if stringInSlice(r.Method, unsafeMethods) {
+		return true
+	}
+
+	if h.cfg.MethodOverride != nil {
+		for _, method := range h.cfg.MethodOverride.methods(r) {
+			if stringInSlice(method, unsafeMethods) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Checks whether a rule allows the origin by name. Origins on the deny list or refused by a deny rule
+// are not, and neither are those only "*" allows, since that would let any site through.
+func (h *Handler) isAllowlisted(source string, r *http.Request) bool {
+	if h.cfg.denied.matches(source) {
+		return false
+	}
+
+	if _, deny := h.cfg.deniedBy(source, r.Host, r.URL.Path); deny != nil {
+		return false
+	}
+
+	var rule string
+	var cfg *host
+	if source == r.Header.Get(originHeader) {
+		rule, cfg, _ = h.cfg.policyFor(r, r.Method, r.Header.Get(requestHeadersHeader))
+	} else {
+		rule, cfg = h.cfg.matchOrigin(source, r.Host, r.URL.Path)
+	}
+
+	return cfg != nil && rule != allToken
+}
+
+// Returns the origin of the Referer header, if any.
+func refererOrigin(r *http.Request) string {
+	u, err := url.Parse(r.Header.Get(refererHeader))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// Returns the origin the request was sent to, using X-Forwarded-Proto when TLS was terminated before.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if proto := r.Header.Get(forwardedProtoHeader); proto != "" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,109 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Decision records the outcome of running the CORS specification against a request.
+type Decision struct {
+	Allowed   bool
+	Preflight bool
+	Origin    string
+	Method    string
+	Headers   string
+	Host      string
+	Path      string
+
+	// PrivateNetwork is set for preflights asking for Private Network Access.
+	// WebSocket is set for WebSocket handshakes.
+	PrivateNetwork bool
+	WebSocket      bool
+
+	// Rule is the configured origin key that matched, Match describes why it matched.
+	// Scope is the path entry of the rule that matched, if it is scoped to paths.
+	// VirtualHost names the virtual host whose rules applied, if any.
+	Rule        string
+	Match       string
+	Scope       string
+	VirtualHost string
+
+	// Reason holds the error message when the request is denied.
+	Reason string
+
+	// Header holds the response headers the middleware emits for the request.
+	// ExposePatterns lists the patterns whose matching upstream headers are exposed as well.
+	Header         http.Header
+	ExposePatterns []string
+
+	// Isolation holds the cross-origin isolation headers set on the upstream response. Unless
+	// IsolationOverride is set, the values set upstream are kept.
+	Isolation         http.Header
+	IsolationOverride bool
+}
+
+// Creates a decision for the given request, allowed until proven otherwise.
+func newDecision(r *http.Request) *Decision {
+	return &Decision{
+		Allowed: true,
+		Origin:  r.Header.Get(originHeader),
+		Method:  r.Method,
+		Headers: r.Header.Get(requestHeadersHeader),
+		Host:    r.Host,
+		Path:    r.URL.Path,
+		Header:  http.Header{},
+
+		PrivateNetwork: r.Method == optionsMethod && r.Header.Get(requestNetworkHeader) == "true",
+		WebSocket:      isWebSocket(r),
+	}
+}
+
+// Marks the decision as denied for the given reason.
+func (d *Decision) deny(reason string) {
+	d.Allowed = false
+	d.Reason = reason
+}
+
+// Returns the key of the request in the decision cache. It holds every part of the request decide looks at.
+func (m *Middleware) decisionKey(r *http.Request) string {
+	key := []string{
+		r.Method,
+		r.Header.Get(originHeader),
+		r.Header.Get(requestMethodHeader),
+		r.Header.Get(requestHeadersHeader),
+		r.Header.Get(requestNetworkHeader),
+		r.Header.Get(fetchSiteHeader),
+		r.Header.Get(fetchModeHeader),
+		r.Header.Get(fetchDestHeader),
+		r.Header.Get(upgradeHeader),
+		r.Header.Get(connectionHeader),
+		r.Host,
+		r.URL.Path,
+		requestOrigin(r),
+	}
+
+	key = append(key, m.constrainedValues(r)...)
+
+	for _, name := range m.required {
+		key = append(key, fmt.Sprint(r.Header.Get(name) != ""))
+	}
+
+	if m.MethodOverride != nil {
+		for _, name := range m.MethodOverride.headers() {
+			key = append(key, r.Header.Get(name))
+		}
+	}
+
+	if m.CSRF != nil {
+		key = append(key, refererOrigin(r), fmt.Sprint(m.CSRF.exempt(r)))
+	}
+
+	return strings.Join(key, "\n")
+}
+
+// Checks whether the decision may be reused for identical requests. Decisions made while the policy
+// service was failing are not.
+func (d *Decision) cacheable() bool {
+	return d.Reason != errorDelegate && d.Rule != delegateFailedRule
+}
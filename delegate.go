@@ -0,0 +1,135 @@
+package cors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// delegate struct configures the policy service asked about requests no rule matches.
+type delegate struct {
+	URL     string      `yaml:"url" json:"url" toml:"url"`
+	Timeout int64       `yaml:"timeout_ms,omitempty" json:"timeout_ms,omitempty" toml:"timeout_ms,omitempty"`
+	Fail    string      `yaml:"fail,omitempty" json:"fail,omitempty" toml:"fail,omitempty"`
+	Cache   cacheConfig `yaml:"cache,omitempty" json:"cache,omitempty" toml:"cache,omitempty"`
+
+	client *http.Client
+	cache  *lru
+}
+
+// delegateRequest is what the policy service is sent.
+type delegateRequest struct {
+	Origin  string   `json:"origin"`
+	Method  string   `json:"method"`
+	Headers []string `json:"headers"`
+	Path    string   `json:"path"`
+	Host    string   `json:"host"`
+}
+
+// delegateResponse is what the policy service answers. An allowed request is allowed the method and
+// headers it was sent with.
+type delegateResponse struct {
+	Allowed       bool     `json:"allowed"`
+	ExposeHeaders []string `json:"expose_headers"`
+	Credentials   bool     `json:"credentials"`
+	MaxAge        int64    `json:"max_age"`
+}
+
+// Validates the delegation settings and prepares its client and cache.
+func (d *delegate) init() error {
+	if u, err := url.Parse(d.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%s %q", errorConfigURL, d.URL)
+	}
+
+	if d.Fail == "" {
+		d.Fail = failClosed
+	} else if d.Fail != failClosed && d.Fail != failOpen {
+		return fmt.Errorf("%s %q", errorConfigFail, d.Fail)
+	}
+
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = defaultDelegateTimeout
+	}
+
+	d.client = &http.Client{Timeout: time.Duration(timeout) * time.Millisecond}
+	d.cache = newLRU(d.Cache)
+	return nil
+}
+
+// Asks the policy service about the request for the given method and request headers.
+// Answers are cached, failures are not: depending on Fail they allow the request or return the error.
+func (d *delegate) decide(r *http.Request, method string, headers string) (string, *host, error) {
+	req := delegateRequest{
+		Origin: r.Header.Get(originHeader),
+		Method: method,
+		Path:   r.URL.Path,
+		Host:   hostname(r.Host),
+	}
+
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			req.Headers = append(req.Headers, http.CanonicalHeaderKey(h))
+		}
+	}
+
+	key := strings.Join([]string{req.Origin, req.Method, strings.Join(req.Headers, ","), req.Path, req.Host}, "\n")
+	if cached, ok := d.cache.get(key); ok {
+		cfg, _ := cached.(*host)
+		return delegateRule, cfg, nil
+	}
+
+	res, err := d.ask(req)
+	if err != nil {
+		metrics.Add(delegateErrorMetric, 1)
+		if d.Fail == failOpen {
+			return delegateFailedRule, &host{Origins: []string{req.Origin}, Methods: []string{method}, Headers: []string{allToken}}, nil
+		}
+
+		return "", nil, err
+	}
+
+	var cfg *host
+	if res.Allowed {
+		cfg = &host{
+			Origins:       []string{req.Origin},
+			Methods:       []string{method},
+			Headers:       []string{allToken},
+			ExposeHeaders: canonicalHeaders(res.ExposeHeaders),
+			Credentials:   res.Credentials,
+			MaxAge:        res.MaxAge,
+		}
+	}
+
+	d.cache.add(key, cfg)
+	return delegateRule, cfg, nil
+}
+
+// Sends the request to the policy service.
+func (d *delegate) ask(req delegateRequest) (*delegateResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Post(d.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy service answered %v", resp.Status)
+	}
+
+	var res delegateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
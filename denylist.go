@@ -0,0 +1,113 @@
+package cors
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// denyList holds the origins refused before any rule is considered. The origins read from
+// the deny list file are replaced whenever the file changes, without rebuilding the middleware.
+type denyList struct {
+	static *originList
+	file   string
+
+	// The decisions to drop when the file is reloaded, if decisions are cached.
+	decisions *lru
+
+	mu      sync.RWMutex
+	loaded  *originList
+	modTime time.Time
+	checked time.Time
+}
+
+// Creates the deny list from the configured origins and file.
+func newDenyList(origins []string, file string, decisions *lru) (*denyList, error) {
+	static, err := newOriginList(origins)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &denyList{static: static, file: file, decisions: decisions}
+	if file != "" {
+		if err := l.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Checks whether the origin is denied, picking up changes to the deny list file first.
+func (l *denyList) matches(origin string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.reloadIfChanged()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.static.matches(origin) || l.loaded.matches(origin)
+}
+
+// Reads the deny list file again and replaces the origins loaded from it.
+func (l *denyList) reload() error {
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+
+	origins, err := readOriginsFile(l.file)
+	if err != nil {
+		return err
+	}
+
+	loaded, err := newOriginList(origins)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.loaded = loaded
+	l.modTime = info.ModTime()
+	l.checked = time.Now()
+	l.mu.Unlock()
+
+	if l.decisions != nil {
+		l.decisions.purge()
+	}
+
+	return nil
+}
+
+// Reloads the deny list file when it was modified, checking at most once per denyListCheckInterval.
+// A file that can't be read keeps the origins loaded last.
+func (l *denyList) reloadIfChanged() {
+	if l.file == "" {
+		return
+	}
+
+	l.mu.Lock()
+	if time.Since(l.checked) < denyListCheckInterval {
+		l.mu.Unlock()
+		return
+	}
+	l.checked = time.Now()
+	modTime := l.modTime
+	l.mu.Unlock()
+
+	if info, err := os.Stat(l.file); err == nil && !info.ModTime().Equal(modTime) {
+		l.reload()
+	}
+}
+
+// ReloadDenyOrigins reads the deny list file again, without rebuilding the rest of the middleware.
+func (m *Middleware) ReloadDenyOrigins() error {
+	if m.denied == nil || m.denied.file == "" {
+		return nil
+	}
+
+	return m.denied.reload()
+}
@@ -0,0 +1,164 @@
+package cors
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+// Explain simulates a browser sending a preflight followed by the actual request for the given
+// origin, method, request headers, host and path, and returns the decision made for each.
+// Headers may carry the value the actual request sends as "Name: value".
+func (m *Middleware) Explain(origin string, method string, headers []string, requestHost string, path string) (*Decision, *Decision, error) {
+	h := &Handler{cfg: *m}
+
+	var names, values, unchecked []string
+	for _, header := range headers {
+		name, value := splitHeader(header)
+		if value == "" {
+			value = placeholderValue
+			unchecked = append(unchecked, name)
+		}
+
+		names = append(names, name)
+		values = append(values, value)
+	}
+
+	preflight, err := http.NewRequest(optionsMethod, path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	preflight.Host = requestHost
+	preflight.Header.Set(originHeader, origin)
+	preflight.Header.Set(requestMethodHeader, method)
+	if len(names) > 0 {
+		preflight.Header.Set(requestHeadersHeader, strings.Join(names, ","))
+	}
+
+	actual, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	actual.Host = requestHost
+	actual.Header.Set(originHeader, origin)
+	for i, name := range names {
+		actual.Header.Set(name, values[i])
+	}
+
+	return h.decide(preflight), h.decideUnchecked(actual, unchecked), nil
+}
+
+// Splits a "Name: value" header. The value is empty for headers given without one.
+func splitHeader(header string) (string, string) {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) < 2 {
+		return strings.TrimSpace(parts[0]), ""
+	}
+
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// ExplainFromCli prints how the middleware configured on the command line treats a simulated request.
+func ExplainFromCli(c *cli.Context) error {
+	config, err := readConfig(c.String(corsFile))
+	if err != nil {
+		return err
+	}
+
+	m, err := New(config)
+	if err != nil {
+		return err
+	}
+
+	var headers []string
+	for _, h := range c.StringSlice(headerFlag) {
+		headers = append(headers, strings.Split(h, ",")...)
+	}
+
+	method := c.String(methodFlag)
+	path := c.String(pathFlag)
+	preflight, actual, err := m.Explain(c.String(originFlag), method, headers, c.String(hostFlag), path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%s %s from %s\n\n", method, path, c.String(originFlag))
+	writeDecision(os.Stdout, "Preflight", preflight)
+	writeDecision(os.Stdout, "Actual request", actual)
+
+	return nil
+}
+
+// ExplainCliFlags will be used to construct help and the `explain` command for `vctl cors`
+func ExplainCliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{"corsFile, cf", "", "YAML, JSON or TOML configuration file", ""},
+		cli.StringFlag{originFlag, "", "origin sending the request", ""},
+		cli.StringFlag{methodFlag, "GET", "request method", ""},
+		cli.StringSliceFlag{headerFlag, &cli.StringSlice{}, "request header, optionally as 'Name: value', may be repeated", ""},
+		cli.StringFlag{hostFlag, "", "request host", ""},
+		cli.StringFlag{pathFlag, "/", "request path", ""},
+	}
+}
+
+// Writes a human readable account of the decision.
+func writeDecision(w io.Writer, label string, d *Decision) {
+	result := "allowed"
+	if !d.Allowed {
+		result = "denied (" + d.Reason + ")"
+	}
+
+	fmt.Fprintf(w, "%s: %s\n", label, result)
+	if d.Rule != "" {
+		fmt.Fprintf(w, "  rule: %s\n", d.Rule)
+		fmt.Fprintf(w, "  why:  %s\n", d.Match)
+	}
+
+	if d.VirtualHost != "" {
+		fmt.Fprintf(w, "  host: %s\n", d.VirtualHost)
+	}
+
+	if d.Scope != "" {
+		fmt.Fprintf(w, "  path: %s\n", d.Scope)
+	}
+
+	fmt.Fprintln(w, "  response headers:")
+	for _, name := range sortedKeys(d.Header) {
+		fmt.Fprintf(w, "    %s: %s\n", name, strings.Join(d.Header[name], ", "))
+	}
+
+	if len(d.Isolation) > 0 {
+		mode := isolationMerge
+		if d.IsolationOverride {
+			mode = isolationOverride
+		}
+
+		fmt.Fprintf(w, "  isolation headers (%s):\n", mode)
+		for _, name := range sortedKeys(d.Isolation) {
+			fmt.Fprintf(w, "    %s: %s\n", name, d.Isolation.Get(name))
+		}
+	}
+
+	if len(d.ExposePatterns) > 0 {
+		fmt.Fprintf(w, "  also exposes upstream headers matching: %s\n", strings.Join(d.ExposePatterns, ", "))
+	}
+	fmt.Fprintln(w)
+}
+
+// Returns the header names in order.
+func sortedKeys(header http.Header) []string {
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
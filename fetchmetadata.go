@@ -0,0 +1,50 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// fetchMetadata struct configures the Fetch Metadata resource isolation policy, which refuses
+// cross-site requests unless they are navigations or come from an allowed origin.
+type fetchMetadata struct {
+	// Paths the policy applies to, every path when empty.
+	Paths []string `yaml:"paths,omitempty" json:"paths,omitempty" toml:"paths,omitempty"`
+
+	// BlockNavigation refuses cross-site navigations as well, BlockSameSite same-site requests.
+	BlockNavigation bool `yaml:"block_navigation,omitempty" json:"block_navigation,omitempty" toml:"block_navigation,omitempty"`
+	BlockSameSite   bool `yaml:"block_same_site,omitempty" json:"block_same_site,omitempty" toml:"block_same_site,omitempty"`
+}
+
+// Checks the request against the Fetch Metadata policy. Requests without Sec-Fetch-Site, from
+// browsers that don't send it, are let through for the CORS rules to decide.
+func (h *Handler) checkFetchMetadata(d *Decision, r *http.Request) bool {
+	policy := h.cfg.FetchMetadata
+	site := r.Header.Get(fetchSiteHeader)
+	if policy == nil || site == "" {
+		return true
+	}
+
+	if _, specificity := bestPath(policy.Paths, r.URL.Path); len(policy.Paths) > 0 && specificity < 0 {
+		return true
+	}
+
+	mode, dest := r.Header.Get(fetchModeHeader), r.Header.Get(fetchDestHeader)
+	switch {
+	case site == "same-origin" || site == "none":
+		return true
+	case site == "same-site" && !policy.BlockSameSite:
+		return true
+	case mode == "navigate" && r.Method == "GET" && dest != "object" && dest != "embed" && !policy.BlockNavigation:
+		return true
+	}
+
+	if d.Origin != "" && h.isAllowlisted(d.Origin, r) {
+		return true
+	}
+
+	d.Rule = metadataRule
+	d.Match = fmt.Sprintf("%s request with mode %q and destination %q", site, mode, dest)
+	d.deny(errorFetchMetadata)
+	return false
+}
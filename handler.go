@@ -1,6 +1,7 @@
 package cors
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -15,67 +16,269 @@ type Handler struct {
 
 // Runs the CORS specification on the request before passing it to the next middleware chain
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.prepResponse(w)
+	d := h.cachedDecision(r)
+	countDecision(d)
 
-	if r.Method == optionsMethod {
-		h.handlePreflight(w, r)
+	if !d.Allowed {
+		h.requestDenied(w, r, d)
+		if h.cfg.Defaults.Mode != reportMode {
+			copyHeaders(w.Header(), d.Header)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else if h.cfg.Defaults.Log == logAll {
+		log.Printf("request allowed by CORS: %v %v from %v (%v)\n", d.Method, r.URL.Path, d.Origin, d.Match)
+	}
+
+	if d.Preflight {
+		copyHeaders(w.Header(), d.Header)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	h.handleRequest(w, r)
-	h.next.ServeHTTP(w, r)
+	rw := h.wrapResponse(w, d)
+	h.next.ServeHTTP(rw, r)
+	rw.finish()
+}
+
+// Sets the decided headers and wraps the response passed upstream, so the Access-Control headers
+// the upstream changes can be stripped, merged or kept according to UpstreamHeaders.
+func (h *Handler) wrapResponse(w http.ResponseWriter, d *Decision) *responseWriter {
+	copyHeaders(w.Header(), d.Header)
+
+	return &responseWriter{
+		ResponseWriter:    w,
+		cors:              d.Header,
+		upstream:          h.cfg.Defaults.UpstreamHeaders,
+		exposePatterns:    d.ExposePatterns,
+		isolation:         d.Isolation,
+		overrideIsolation: d.IsolationOverride,
+	}
+}
+
+// Adds the headers to the response headers.
+func copyHeaders(dst http.Header, src http.Header) {
+	for k, v := range src {
+		dst[k] = append(dst[k], v...)
+	}
+}
+
+// Returns the decision made for an identical request when the decision cache holds one, or decides.
+// Cached decisions are shared and must not be changed.
+func (h *Handler) cachedDecision(r *http.Request) *Decision {
+	if h.cfg.decisions == nil {
+		return h.decide(r)
+	}
+
+	// Cached decisions skip the deny list, which has to notice changes to its file all the same.
+	if h.cfg.denied != nil {
+		h.cfg.denied.reloadIfChanged()
+	}
+
+	key := h.cfg.decisionKey(r)
+	if cached, ok := h.cfg.decisions.get(key); ok {
+		metrics.Add(cacheHitMetric, 1)
+		return cached.(*Decision)
+	}
+
+	metrics.Add(cacheMissMetric, 1)
+	d := h.decide(r)
+	if d.cacheable() {
+		h.cfg.decisions.add(key, d)
+	}
+
+	return d
+}
+
+// Runs the CORS specification on the request and records the outcome
+func (h *Handler) decide(r *http.Request) *Decision {
+	return h.decideUnchecked(r, nil)
+}
+
+// Decides like decide, leaving the values of the unchecked headers alone. Explain uses it for the
+// headers it is given without a value.
+func (h *Handler) decideUnchecked(r *http.Request, unchecked []string) *Decision {
+	d := newDecision(r)
+	h.prepResponse(d)
+
+	if !h.checkFetchMetadata(d, r) || !h.checkCSRF(d, r) {
+		return d
+	}
+
+	if d.Origin == "" && h.cfg.Defaults.Mode != strictMode {
+		d.Match = "request has no Origin header"
+		d.Isolation, d.IsolationOverride = h.cfg.isolationFor(r.URL.Path, nil)
+		return d
+	}
+
+	if d.WebSocket {
+		h.handleWebSocket(d, r)
+		return d
+	}
+
+	if r.Method == optionsMethod {
+		d.Preflight = true
+		h.handlePreflight(d, r)
+		return d
+	}
+
+	cfg := h.handleRequest(d, r, unchecked)
+	d.Isolation, d.IsolationOverride = h.cfg.isolationFor(r.URL.Path, cfg)
+	return d
 }
 
 // Runs the CORS specification for OPTION requests
-func (h *Handler) handlePreflight(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handlePreflight(d *Decision, r *http.Request) {
 	method := r.Header.Get(requestMethodHeader)
 	if method == "" {
 		method = r.Method
 	}
 
-	h.handleMaxAge(w, r)
+	cfg := h.handleCommon(d, r, method)
 
-	h.handleCommon(w, r, method)
+	h.handleMaxAge(d, cfg)
 }
 
-func (h *Handler) handleMaxAge(w http.ResponseWriter, r *http.Request) {
-	maxAge := strconv.Itoa(int(h.cfg.maxAgeForOrigin(r.Header.Get(originHeader))))
+func (h *Handler) handleMaxAge(d *Decision, cfg *host) {
+	maxAge := strconv.Itoa(int(h.cfg.maxAge(cfg)))
 
-	w.Header().Set(maxAgeHeader, maxAge)
+	d.Header.Set(maxAgeHeader, maxAge)
 }
 
 // Runs the CORS specification for standard requests
-func (h *Handler) handleRequest(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) handleRequest(d *Decision, r *http.Request, unchecked []string) *host {
 	method := r.Method
-	h.handleCommon(w, r, method)
+	cfg := h.handleCommon(d, r, method)
+	if cfg != nil && d.Allowed {
+		h.checkMethodOverride(d, r, cfg)
+	}
+
+	if cfg != nil && d.Allowed {
+		if violation := h.cfg.headerViolation(r, cfg, unchecked); violation != "" {
+			d.Match = fmt.Sprintf("%s, but %s", d.Match, violation)
+			d.deny(errorHeaderValue)
+		}
+	}
+
+	return cfg
 }
 
-// Shares common functionality for prefilght and standard requests
-func (h *Handler) handleCommon(w http.ResponseWriter, r *http.Request, method string) {
+// Shares common functionality for prefilght and standard requests.
+// Returns the policy that applied to the origin, if any.
+func (h *Handler) handleCommon(d *Decision, r *http.Request, method string) *host {
+	d.Method = method
+
 	origin := r.Header.Get(originHeader)
-	if !h.cfg.isOriginAllowed(origin) {
-		h.requestDenied(w, r, errorBadOrigin)
-		return
+	headers := r.Header.Get(requestHeadersHeader)
+	cfg := h.matchRule(d, r, method, headers)
+	if cfg == nil {
+		return nil
 	}
 
-	if !h.cfg.isMethodAllowed(method, origin) {
-		h.requestDenied(w, r, errorBadMethod)
-		return
+	if d.Preflight {
+		d.Header.Add(varyHeader, requestNetworkHeader)
 	}
 
-	headers := r.Header.Get(requestHeadersHeader)
-	if !h.cfg.areHeadersAllowed(strings.Split(headers, ","), origin) {
-		h.requestDenied(w, r, errorBadHeader)
-		return
+	if !h.cfg.isMethodAllowed(method, cfg) {
+		d.deny(errorBadMethod)
+		return cfg
+	}
+
+	if !h.cfg.areHeadersAllowed(strings.Split(headers, ","), cfg) {
+		d.deny(errorBadHeader)
+		return cfg
 	}
 
-	h.buildResponse(w, r, origin, method, headers)
+	if d.PrivateNetwork && !cfg.AllowPrivateNetwork {
+		d.deny(errorBadNetwork)
+		return cfg
+	}
+
+	if missing := missingHeader(d, r, cfg); missing != "" {
+		d.Match = fmt.Sprintf("%s, but the request lacks %s", d.Match, missing)
+		d.deny(errorMissingHeader)
+		return cfg
+	}
+
+	h.buildResponse(d, cfg, origin, method, headers)
+	return cfg
+}
+
+// Returns the first header the rule requires that the request lacks. Preflights must list the
+// header in Access-Control-Request-Headers instead of carrying it.
+func missingHeader(d *Decision, r *http.Request, cfg *host) string {
+	var requested []string
+	if d.Preflight {
+		requested = splitList([]string{r.Header.Get(requestHeadersHeader)})
+	}
+
+	for _, name := range cfg.RequireHeaders {
+		if d.Preflight && !headerMatches(name, requested) || !d.Preflight && r.Header.Get(name) == "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// Finds the policy for the request's origin, after the deny list and deny rules, and records the rule
+// that decided. Returns nil when the origin is denied.
+func (h *Handler) matchRule(d *Decision, r *http.Request, method string, headers string) *host {
+	if vh, _ := h.cfg.rulesForHost(r.Host); vh != nil {
+		d.VirtualHost = vh.String()
+	}
+
+	origin := r.Header.Get(originHeader)
+	if origin != "" && h.cfg.denied.matches(origin) {
+		d.Rule = denyListRule
+		d.Match = fmt.Sprintf("origin %q is on the deny list", origin)
+		d.deny(errorBlockedOrigin)
+		return nil
+	}
+
+	if rule, deny := h.cfg.deniedBy(origin, r.Host, r.URL.Path); deny != nil {
+		d.Rule = rule
+		if deny.Name != "" {
+			d.Rule = deny.Name
+		}
+
+		d.Match = h.cfg.describeMatch(rule, origin)
+		d.deny(errorDeniedOrigin)
+		return nil
+	}
+
+	rule, cfg, err := h.cfg.policyFor(r, method, headers)
+	if err != nil {
+		d.Rule = delegateRule
+		d.Match = err.Error()
+		d.deny(errorDelegate)
+		return nil
+	} else if cfg == nil {
+		d.deny(errorBadOrigin)
+		return nil
+	}
+
+	d.Scope, _ = bestPath(cfg.Paths, r.URL.Path)
+	d.Rule = rule
+	if cfg.Name != "" {
+		d.Rule = cfg.Name
+	}
+
+	d.Match = h.cfg.describeMatch(rule, origin)
+	return cfg
 }
 
-// Sets the HTTP status to forbidden and logs error message
-func (h *Handler) requestDenied(w http.ResponseWriter, r *http.Request, m string) {
-	log.Println(errorRoot, m)
+// Logs why the request was denied, along with what matched and the constraint it broke, if any
+func (h *Handler) requestDenied(w http.ResponseWriter, r *http.Request, d *Decision) {
+	if h.cfg.Defaults.Log == logNone {
+		return
+	}
+
+	if d.Match != "" {
+		log.Printf("%v %v (%v)\n", errorRoot, d.Reason, d.Match)
+	} else {
+		log.Println(errorRoot, d.Reason)
+	}
 
 	log.Printf("ORIGIN: %v\n", r.Header.Get(originHeader))
 	log.Printf("METHOD: %v\n", r.Method)
@@ -86,19 +289,68 @@ func (h *Handler) requestDenied(w http.ResponseWriter, r *http.Request, m string
 		h = http.CanonicalHeaderKey(h)
 		log.Printf("%v: %v\n", h, r.Header.Get(h))
 	}
-
-	w.WriteHeader(http.StatusForbidden)
-	return
 }
 
 // Preconfigure headers on the response
-func (h *Handler) prepResponse(w http.ResponseWriter) {
-	w.Header().Add(varyHeader, originHeader)
+func (h *Handler) prepResponse(d *Decision) {
+	d.Header.Add(varyHeader, originHeader)
 }
 
 // Writes the Access Control response headers
-func (h *Handler) buildResponse(w http.ResponseWriter, r *http.Request, origin string, method string, headers string) {
-	w.Header().Set(allowOriginHeader, origin)
-	w.Header().Set(allowMethodsHeader, method)
-	w.Header().Set(allowHeadersHeader, headers)
+func (h *Handler) buildResponse(d *Decision, cfg *host, origin string, method string, headers string) {
+	d.Header.Set(allowOriginHeader, origin)
+	d.Header.Set(allowMethodsHeader, method)
+	d.Header.Set(allowHeadersHeader, headers)
+
+	if cfg.Credentials {
+		d.Header.Set(credentialsHeader, "true")
+	}
+
+	if d.Preflight {
+		if d.PrivateNetwork {
+			d.Header.Set(allowNetworkHeader, "true")
+		}
+
+		return
+	}
+
+	var expose []string
+	for _, h := range cfg.ExposeHeaders {
+		if isHeaderPattern(h) {
+			d.ExposePatterns = append(d.ExposePatterns, h)
+		} else {
+			expose = append(expose, h)
+		}
+	}
+
+	if len(expose) > 0 {
+		d.Header.Set(exposeHeader, strings.Join(expose, ", "))
+	}
+
+	h.handleTiming(d, cfg, origin)
+}
+
+// Writes the Timing-Allow-Origin header, "origin" standing for the request's origin
+func (h *Handler) handleTiming(d *Decision, cfg *host, origin string) {
+	if len(cfg.TimingAllowOrigin) == 0 {
+		return
+	}
+
+	if stringInSlice(allToken, cfg.TimingAllowOrigin) {
+		d.Header.Set(timingHeader, allToken)
+		return
+	}
+
+	var origins []string
+	for _, o := range cfg.TimingAllowOrigin {
+		if o == originToken {
+			o = origin
+		}
+
+		if !stringInSlice(o, origins) {
+			origins = append(origins, o)
+		}
+	}
+
+	d.Header.Set(timingHeader, strings.Join(origins, ", "))
 }
@@ -0,0 +1,83 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerValue struct constrains the values of a request header, or of the headers matching a pattern
+// such as "X-Client-*".
+type headerValue struct {
+	Header string `yaml:"header" json:"header" toml:"header"`
+
+	// Values lists the values allowed, exactly or as /regular expressions/, ignoring parameters
+	// such as "; charset=utf-8". MaxLength limits the length of the whole value.
+	Values    []string `yaml:"values,omitempty" json:"values,omitempty" toml:"values,omitempty"`
+	MaxLength int      `yaml:"max_length,omitempty" json:"max_length,omitempty" toml:"max_length,omitempty"`
+}
+
+// Checks that the constraint names a header and constrains it somehow.
+func (v *headerValue) validate() error {
+	if v.Header == "" || v.MaxLength < 0 || len(v.Values) == 0 && v.MaxLength == 0 {
+		return fmt.Errorf("%s %+v", errorConfigValue, *v)
+	}
+
+	return nil
+}
+
+// Returns the constraint the request's headers break for the rule, if any. The unchecked headers
+// are left alone.
+func (m *Middleware) headerViolation(r *http.Request, cfg *host, unchecked []string) string {
+	for _, constraint := range cfg.HeaderValues {
+		for _, name := range sortedKeys(r.Header) {
+			if !headerMatches(name, []string{constraint.Header}) || headerMatches(name, unchecked) {
+				continue
+			}
+
+			for _, value := range r.Header[name] {
+				if constraint.MaxLength > 0 && len(value) > constraint.MaxLength {
+					return fmt.Sprintf("%s is longer than %d", name, constraint.MaxLength)
+				}
+
+				if len(constraint.Values) > 0 && !m.valueAllowed(value, constraint.Values) {
+					return fmt.Sprintf("%s must be one of %s", name, strings.Join(constraint.Values, ", "))
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// Checks a header value, without its parameters, against the allowed values and patterns.
+func (m *Middleware) valueAllowed(value string, allowed []string) bool {
+	value = strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+	for _, a := range allowed {
+		if re, ok := m.patterns[a]; ok {
+			if re.MatchString(value) {
+				return true
+			}
+		} else if strings.EqualFold(a, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the request headers some rule constrains along with their values, for decisionKey.
+func (m *Middleware) constrainedValues(r *http.Request) []string {
+	if len(m.constrained) == 0 {
+		return nil
+	}
+
+	var values []string
+	for _, name := range sortedKeys(r.Header) {
+		if headerMatches(name, m.constrained) {
+			values = append(values, name+": "+strings.Join(r.Header[name], ", "))
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,97 @@
+package cors
+
+import "fmt"
+
+// Computes the effective policy of every rule, merging in the rule or defaults it extends.
+// Rule names are shared between the top level rules and those of virtual hosts.
+func resolveRules(m *Middleware) error {
+	named := map[string]*host{}
+	for _, rule := range m.allRules() {
+		if rule.Name != "" {
+			if named[rule.Name] != nil {
+				return fmt.Errorf("%s %q", errorConfigName, rule.Name)
+			}
+
+			named[rule.Name] = rule
+		}
+
+		rule.effective = nil
+	}
+
+	for _, rule := range m.allRules() {
+		if _, err := resolveRule(m, rule, named, map[*host]bool{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the effective policy of the rule, resolving the rule it extends first.
+func resolveRule(m *Middleware, rule *host, named map[string]*host, visiting map[*host]bool) (*host, error) {
+	if rule.effective != nil {
+		return rule.effective, nil
+	}
+
+	if visiting[rule] {
+		return nil, fmt.Errorf("%s %q", errorConfigCycle, rule.Name)
+	}
+	visiting[rule] = true
+
+	effective := *rule
+	switch rule.Extend {
+	case "":
+	case defaultsRule:
+		inherit(&effective, &host{
+			Methods:       m.Defaults.Methods,
+			Headers:       m.Defaults.Headers,
+			ExposeHeaders: m.Defaults.ExposeHeaders,
+			MaxAge:        m.Defaults.MaxAge,
+		})
+	default:
+		base := named[rule.Extend]
+		if base == nil {
+			return nil, fmt.Errorf("%s %q", errorConfigExtend, rule.Extend)
+		}
+
+		basePolicy, err := resolveRule(m, base, named, visiting)
+		if err != nil {
+			return nil, err
+		}
+
+		inherit(&effective, basePolicy)
+	}
+
+	effective.Methods = without(effective.Methods, rule.RemoveMethods)
+	effective.Headers = without(effective.Headers, rule.RemoveHeaders)
+	effective.ExposeHeaders = without(effective.ExposeHeaders, rule.RemoveExposeHeaders)
+
+	rule.effective = &effective
+	return rule.effective, nil
+}
+
+// Adds the base policy to the rule's own policy.
+func inherit(rule *host, base *host) {
+	rule.Methods = union(base.Methods, rule.Methods)
+	rule.Headers = union(base.Headers, rule.Headers)
+	rule.ExposeHeaders = union(base.ExposeHeaders, rule.ExposeHeaders)
+	rule.ExceptMethods = union(base.ExceptMethods, rule.ExceptMethods)
+	rule.ExceptHeaders = union(base.ExceptHeaders, rule.ExceptHeaders)
+	rule.RequireHeaders = union(base.RequireHeaders, rule.RequireHeaders)
+	rule.HeaderValues = append(append([]*headerValue{}, base.HeaderValues...), rule.HeaderValues...)
+	rule.TimingAllowOrigin = union(base.TimingAllowOrigin, rule.TimingAllowOrigin)
+	rule.Credentials = rule.Credentials || base.Credentials
+	rule.AllowPrivateNetwork = rule.AllowPrivateNetwork || base.AllowPrivateNetwork
+
+	if rule.MaxAge == 0 {
+		rule.MaxAge = base.MaxAge
+	}
+
+	if rule.WebSocket == nil {
+		rule.WebSocket = base.WebSocket
+	}
+
+	if rule.Isolation == nil {
+		rule.Isolation = base.Isolation
+	}
+}
@@ -0,0 +1,96 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// isolation struct configures the cross-origin isolation headers of upstream responses. At the top
+// level it is scoped to paths like rules are, and a rule's own settings win over it for its origins.
+type isolation struct {
+	Paths          []string `yaml:"paths,omitempty" json:"paths,omitempty" toml:"paths,omitempty"`
+	ResourcePolicy string   `yaml:"resource_policy,omitempty" json:"resource_policy,omitempty" toml:"resource_policy,omitempty"`
+	OpenerPolicy   string   `yaml:"opener_policy,omitempty" json:"opener_policy,omitempty" toml:"opener_policy,omitempty"`
+	EmbedderPolicy string   `yaml:"embedder_policy,omitempty" json:"embedder_policy,omitempty" toml:"embedder_policy,omitempty"`
+
+	// Mode is override, replacing the values set upstream, or merge, only filling in those missing.
+	Mode string `yaml:"mode,omitempty" json:"mode,omitempty" toml:"mode,omitempty"`
+}
+
+// The values each isolation header accepts.
+var isolationValues = map[string][]string{
+	resourcePolicyHeader: {"same-site", "same-origin", "cross-origin"},
+	openerPolicyHeader:   {"unsafe-none", "same-origin-allow-popups", "same-origin", "noopener-allow-popups"},
+	embedderPolicyHeader: {"unsafe-none", "require-corp", "credentialless"},
+}
+
+// Returns the configured isolation headers by name.
+func (iso *isolation) values() map[string]string {
+	return map[string]string{
+		resourcePolicyHeader: iso.ResourcePolicy,
+		openerPolicyHeader:   iso.OpenerPolicy,
+		embedderPolicyHeader: iso.EmbedderPolicy,
+	}
+}
+
+// Validates the header values, mode and paths.
+func (iso *isolation) validate() error {
+	for name, value := range iso.values() {
+		if value != "" && !stringInSlice(value, isolationValues[name]) {
+			return fmt.Errorf("%s %v must be one of %v, got %q", errorConfigIsolate, name, strings.Join(isolationValues[name], ", "), value)
+		}
+	}
+
+	if iso.Mode != "" && iso.Mode != isolationOverride && iso.Mode != isolationMerge {
+		return fmt.Errorf("%s mode must be %v or %v, got %q", errorConfigIsolate, isolationOverride, isolationMerge, iso.Mode)
+	}
+
+	return validatePaths(iso.Paths)
+}
+
+// Finds the isolation headers for the request path and the rule that allowed the origin, if any:
+// the top level settings without paths, overlaid with those scoped to the most specific path entry,
+// then with the rule's. Returns the headers and whether they override the values set upstream.
+func (m *Middleware) isolationFor(requestPath string, cfg *host) (http.Header, bool) {
+	var scoped, unscoped *isolation
+	best := -1
+	for _, iso := range m.Isolation {
+		if len(iso.Paths) == 0 {
+			if unscoped == nil {
+				unscoped = iso
+			}
+		} else if _, specificity := bestPath(iso.Paths, requestPath); specificity > best {
+			scoped, best = iso, specificity
+		}
+	}
+
+	layers := []*isolation{unscoped, scoped}
+	if cfg != nil {
+		layers = append(layers, cfg.Isolation)
+	}
+
+	header := http.Header{}
+	mode := isolationOverride
+	for _, iso := range layers {
+		if iso == nil {
+			continue
+		}
+
+		for name, value := range iso.values() {
+			if value != "" {
+				header.Set(name, value)
+			}
+		}
+
+		if iso.Mode != "" {
+			mode = iso.Mode
+		}
+	}
+
+	if len(header) == 0 {
+		return nil, false
+	}
+
+	return header, mode == isolationOverride
+}
@@ -0,0 +1,81 @@
+package cors
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+// Headers that carry credentials and should be listed explicitly rather than through a pattern.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+// Lint returns warnings about configuration that is valid but probably not intended.
+func (m *Middleware) Lint() []string {
+	var warnings []string
+	for _, rule := range m.allRules() {
+		name := rule.Name
+		if name == "" && len(rule.origins()) > 0 {
+			name = rule.origins()[0]
+		}
+
+		warnings = append(warnings, lintPatterns(name, "allows", rule.Headers)...)
+		warnings = append(warnings, lintPatterns(name, "exposes", rule.ExposeHeaders)...)
+
+		policy := rule.policy()
+		for _, required := range policy.RequireHeaders {
+			if !m.areHeadersAllowed([]string{required}, policy) {
+				warnings = append(warnings, fmt.Sprintf("rule %q: required header %q is not allowed, so preflights requesting it are denied", name, required))
+			}
+		}
+	}
+
+	warnings = append(warnings, lintPatterns(defaultsRule, "allows", m.Defaults.Headers)...)
+	warnings = append(warnings, lintPatterns(defaultsRule, "exposes", m.Defaults.ExposeHeaders)...)
+
+	return warnings
+}
+
+// Warns about header patterns that also cover sensitive headers.
+func lintPatterns(rule string, verb string, headers []string) []string {
+	var warnings []string
+	for _, pattern := range headers {
+		if !isHeaderPattern(pattern) {
+			continue
+		}
+
+		for _, sensitive := range sensitiveHeaders {
+			if headerMatches(sensitive, []string{pattern}) {
+				warnings = append(warnings, fmt.Sprintf("rule %q: header pattern %q also %s %s", rule, pattern, verb, sensitive))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// LintFromCli prints the warnings for the configuration file given on the command line.
+func LintFromCli(c *cli.Context) error {
+	config, err := readConfig(c.String(corsFile))
+	if err != nil {
+		return err
+	}
+
+	m, err := New(config)
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range m.Lint() {
+		fmt.Fprintln(os.Stdout, "warning:", warning)
+	}
+
+	return nil
+}
+
+// LintCliFlags will be used to construct help and the `lint` command
+func LintCliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{"corsFile, cf", "", "YAML, JSON or TOML configuration file", ""},
+	}
+}
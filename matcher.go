@@ -0,0 +1,228 @@
+package cors
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// originRef points at a configured origin: the rule, in order, and the origin's position in it.
+type originRef struct {
+	rule  int
+	index int
+}
+
+// Checks whether the reference comes before another one in configuration order.
+func (ref originRef) before(other originRef) bool {
+	return other.rule < 0 || ref.rule < other.rule || ref.rule == other.rule && ref.index < other.index
+}
+
+// labelNode is a node of a trie of host names, keyed by their labels from the last one.
+// Its refs are the "*." origins ending at the node.
+type labelNode struct {
+	children map[string]*labelNode
+	refs     []originRef
+}
+
+// originMatcher finds the rule for an origin among a list of rules without trying each configured origin.
+// Exact origins are kept in a hash set, "scheme://*." origins in a trie of reversed host labels per scheme,
+// and regex origins behind a single combined regex that rejects most origins in one pass.
+type originMatcher struct {
+	rules []*host
+
+	exact    map[string][]originRef
+	suffixes map[string]*labelNode
+	combined *regexp.Regexp
+	patterns []originRef
+	regexes  []*regexp.Regexp
+	globs    []originRef
+	all      []originRef
+
+	// The rules scoped to paths, which decide the scope of every request.
+	scoped []int
+}
+
+// Compiles the origins of the rules that allow origins.
+func newOriginMatcher(rules []*host) (*originMatcher, error) {
+	om := &originMatcher{exact: map[string][]originRef{}, suffixes: map[string]*labelNode{}}
+
+	var bodies []string
+	for _, rule := range rules {
+		if len(rule.origins()) == 0 || rule.Deny {
+			continue
+		}
+
+		i := len(om.rules)
+		om.rules = append(om.rules, rule)
+		if len(rule.Paths) > 0 {
+			om.scoped = append(om.scoped, i)
+		}
+
+		for j, origin := range rule.origins() {
+			ref := originRef{i, j}
+			if origin == allToken {
+				om.all = append(om.all, ref)
+			} else if match := patternSyntax.FindStringSubmatch(origin); match != nil {
+				re, err := regexp.Compile(fmt.Sprintf("^%s$", match[1]))
+				if err != nil {
+					return nil, fmt.Errorf("%s %v: %v", errorConfigPattern, origin, err)
+				}
+
+				om.patterns = append(om.patterns, ref)
+				om.regexes = append(om.regexes, re)
+				bodies = append(bodies, fmt.Sprintf("(?:%s)", match[1]))
+			} else if scheme, suffix := splitSubdomainPattern(origin); suffix != "" {
+				om.addSuffix(scheme, suffix, ref)
+			} else if strings.ContainsAny(origin, globCharacters) {
+				om.globs = append(om.globs, ref)
+			} else {
+				om.exact[origin] = append(om.exact[origin], ref)
+			}
+		}
+	}
+
+	if len(bodies) > 0 {
+		combined, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", strings.Join(bodies, "|")))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", errorConfigPattern, err)
+		}
+
+		om.combined = combined
+	}
+
+	return om, nil
+}
+
+// Splits an origin like https://*.example.com into its scheme and the suffix after "*.".
+// The suffix is empty when the origin isn't of that form.
+func splitSubdomainPattern(origin string) (string, string) {
+	i := strings.Index(origin, "://*.")
+	if i < 0 {
+		return "", ""
+	}
+
+	suffix := origin[i+len("://*."):]
+	if strings.ContainsAny(suffix, globCharacters) {
+		return "", ""
+	}
+
+	return origin[:i], suffix
+}
+
+// Adds a "*." origin to the trie of its scheme.
+func (om *originMatcher) addSuffix(scheme string, suffix string, ref originRef) {
+	node := om.suffixes[scheme]
+	if node == nil {
+		node = &labelNode{}
+		om.suffixes[scheme] = node
+	}
+
+	labels := strings.Split(suffix, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		next := node.children[labels[i]]
+		if next == nil {
+			next = &labelNode{}
+			if node.children == nil {
+				node.children = map[string]*labelNode{}
+			}
+			node.children[labels[i]] = next
+		}
+
+		node = next
+	}
+
+	node.refs = append(node.refs, ref)
+}
+
+// Finds the rule for the origin, preferring an exact match, then a pattern, then "*", then the first
+// rule listed. Only the rules scoped to the most specific path entry matching the request path are
+// considered, or the rules without paths when none is, and rules excepting the origin are skipped.
+// Returns the configured origin that matched along with its rule.
+func (om *originMatcher) match(m *Middleware, origin string, requestPath string) (string, *host) {
+	best := -1
+	for _, i := range om.scoped {
+		if _, specificity := bestPath(om.rules[i].Paths, requestPath); specificity > best {
+			best = specificity
+		}
+	}
+
+	allowed := func(ref originRef) bool {
+		rule := om.rules[ref.rule]
+		if len(rule.Paths) == 0 {
+			if best >= 0 {
+				return false
+			}
+		} else if _, specificity := bestPath(rule.Paths, requestPath); specificity != best || best < 0 {
+			return false
+		}
+
+		return !m.originExcepted(rule, origin)
+	}
+
+	for _, ref := range om.exact[origin] {
+		if allowed(ref) {
+			return om.key(ref), om.rules[ref.rule].policy()
+		}
+	}
+
+	found := originRef{rule: -1}
+	if i := strings.Index(origin, "://"); i >= 0 && len(om.suffixes) > 0 {
+		node, rest := om.suffixes[origin[:i]], origin[i+len("://"):]
+		for node != nil {
+			dot := strings.LastIndexByte(rest, '.')
+			if dot < 0 {
+				break
+			}
+
+			node, rest = node.children[rest[dot+1:]], rest[:dot]
+			if node == nil || rest == "" {
+				break
+			}
+
+			for _, ref := range node.refs {
+				if ref.before(found) && allowed(ref) {
+					found = ref
+				}
+			}
+		}
+	}
+
+	// The combined regex is skipped when a match already comes before every pattern.
+	if len(om.patterns) > 0 && om.patterns[0].before(found) && om.combined.MatchString(origin) {
+		for i, ref := range om.patterns {
+			if !ref.before(found) {
+				break
+			} else if om.regexes[i].MatchString(origin) && allowed(ref) {
+				found = ref
+				break
+			}
+		}
+	}
+
+	for _, ref := range om.globs {
+		if !ref.before(found) {
+			break
+		} else if match, _ := path.Match(om.key(ref), origin); match && allowed(ref) {
+			found = ref
+			break
+		}
+	}
+
+	if found.rule >= 0 {
+		return om.key(found), om.rules[found.rule].policy()
+	}
+
+	for _, ref := range om.all {
+		if allowed(ref) {
+			return allToken, om.rules[ref.rule].policy()
+		}
+	}
+
+	return "", nil
+}
+
+// Returns the configured origin the reference points at.
+func (om *originMatcher) key(ref originRef) string {
+	return om.rules[ref.rule].origins()[ref.index]
+}
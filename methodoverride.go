@@ -0,0 +1,64 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers checked for an overridden method when none are configured.
+var defaultOverrideHeaders = []string{"X-HTTP-Method-Override", "X-HTTP-Method", "X-Method-Override"}
+
+// methodOverride struct configures the headers clients tunnel another method through, such as
+// DELETE sent as a POST with X-HTTP-Method-Override.
+type methodOverride struct {
+	Headers []string `yaml:"headers,omitempty" json:"headers,omitempty" toml:"headers,omitempty"`
+}
+
+// Returns the override header names, or the usual ones when none are configured.
+func (o *methodOverride) headers() []string {
+	if len(o.Headers) == 0 {
+		return defaultOverrideHeaders
+	}
+
+	return o.Headers
+}
+
+// Returns the methods the request's override headers ask for.
+func (o *methodOverride) methods(r *http.Request) []string {
+	var methods []string
+	for _, name := range o.headers() {
+		if method := overriddenMethod(r, name); method != "" {
+			methods = append(methods, method)
+		}
+	}
+
+	return methods
+}
+
+// Returns the method the named override header asks for, if any.
+func overriddenMethod(r *http.Request, name string) string {
+	return strings.ToUpper(strings.TrimSpace(r.Header.Get(name)))
+}
+
+// Checks that the methods the request overrides its own with are allowed for the origin as well,
+// recording the effective method.
+func (h *Handler) checkMethodOverride(d *Decision, r *http.Request, cfg *host) {
+	if h.cfg.MethodOverride == nil {
+		return
+	}
+
+	for _, name := range h.cfg.MethodOverride.headers() {
+		method := overriddenMethod(r, name)
+		if method == "" {
+			continue
+		}
+
+		d.Method = method
+		if !h.cfg.isMethodAllowed(method, cfg) {
+			d.Match = fmt.Sprintf("%s, but %s overrides the method with %s", d.Match, http.CanonicalHeaderKey(name), method)
+			d.deny(errorOverride)
+			return
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package cors
+
+import (
+	"expvar"
+	"strings"
+)
+
+// Counters of CORS decisions, published through expvar as "cors".
+var metrics = expvar.NewMap("cors")
+
+// Counts the decision as allowed, or as denied for its reason.
+func countDecision(d *Decision) {
+	if d.Allowed {
+		metrics.Add(allowedMetric, 1)
+		return
+	}
+
+	metrics.Add(deniedMetric+strings.Replace(d.Reason, " ", "_", -1), 1)
+}
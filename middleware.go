@@ -1,96 +1,326 @@
 package cors
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
 
 	"net/http"
+	"path"
 )
 
-// host struct represents a single configuration for an origin.
+// host struct represents a single configuration for one or more origins.
 type host struct {
-	Methods []string
-	Headers []string
-	MaxAge  int64 `yaml:"max_age"`
+	Name          string   `yaml:"name,omitempty" json:"name,omitempty" toml:"name,omitempty"`
+	Origins       []string `yaml:"origins,omitempty" json:"origins,omitempty" toml:"origins,omitempty"`
+	OriginsFile   string   `yaml:"origins_file,omitempty" json:"origins_file,omitempty" toml:"origins_file,omitempty"`
+	Paths         []string `yaml:"paths,omitempty" json:"paths,omitempty" toml:"paths,omitempty"`
+	Methods       []string `yaml:"methods" json:"methods" toml:"methods"`
+	Headers       []string `yaml:"headers" json:"headers" toml:"headers"`
+	ExposeHeaders []string `yaml:"expose_headers,omitempty" json:"expose_headers,omitempty" toml:"expose_headers,omitempty"`
+	Credentials   bool     `yaml:"credentials,omitempty" json:"credentials,omitempty" toml:"credentials,omitempty"`
+	MaxAge        int64    `yaml:"max_age,omitempty" json:"max_age,omitempty" toml:"max_age,omitempty"`
+
+	// TimingAllowOrigin lists the origins sent as Timing-Allow-Origin on actual responses: "origin" for the
+	// request's origin, fixed origins, or "*".
+	TimingAllowOrigin []string `yaml:"timing_allow_origin,omitempty" json:"timing_allow_origin,omitempty" toml:"timing_allow_origin,omitempty"`
+
+	// Isolation sets the cross-origin isolation headers of the responses to the rule's origins.
+	Isolation *isolation `yaml:"isolation,omitempty" json:"isolation,omitempty" toml:"isolation,omitempty"`
+
+	// RequireHeaders lists the headers every request from the rule's origins must carry. Preflights
+	// must list them in Access-Control-Request-Headers.
+	RequireHeaders []string `yaml:"require_headers,omitempty" json:"require_headers,omitempty" toml:"require_headers,omitempty"`
+
+	// HeaderValues constrains the values of the headers the rule's origins send.
+	HeaderValues []*headerValue `yaml:"header_values,omitempty" json:"header_values,omitempty" toml:"header_values,omitempty"`
+
+	// WebSocket, when set to false, refuses WebSocket handshakes from the rule's origins.
+	WebSocket *bool `yaml:"websocket,omitempty" json:"websocket,omitempty" toml:"websocket,omitempty"`
+
+	// AllowPrivateNetwork answers Private Network Access preflights from public sites.
+	AllowPrivateNetwork bool `yaml:"allow_private_network,omitempty" json:"allow_private_network,omitempty" toml:"allow_private_network,omitempty"`
+
+	// Extend names the rule, or the defaults, whose policy this rule builds on.
+	Extend              string   `yaml:"extend,omitempty" json:"extend,omitempty" toml:"extend,omitempty"`
+	RemoveMethods       []string `yaml:"remove_methods,omitempty" json:"remove_methods,omitempty" toml:"remove_methods,omitempty"`
+	RemoveHeaders       []string `yaml:"remove_headers,omitempty" json:"remove_headers,omitempty" toml:"remove_headers,omitempty"`
+	RemoveExposeHeaders []string `yaml:"remove_expose_headers,omitempty" json:"remove_expose_headers,omitempty" toml:"remove_expose_headers,omitempty"`
+
+	// Exclusions win over everything the rule allows. A deny rule refuses its origins outright.
+	ExceptOrigins []string `yaml:"except_origins,omitempty" json:"except_origins,omitempty" toml:"except_origins,omitempty"`
+	ExceptMethods []string `yaml:"except_methods,omitempty" json:"except_methods,omitempty" toml:"except_methods,omitempty"`
+	ExceptHeaders []string `yaml:"except_headers,omitempty" json:"except_headers,omitempty" toml:"except_headers,omitempty"`
+	Deny          bool     `yaml:"deny,omitempty" json:"deny,omitempty" toml:"deny,omitempty"`
+
+	// The policy merged with what the rule extends, computed by New.
+	effective *host
+
+	// The configured origins along with those read from OriginsFile by New.
+	allOrigins []string
+}
+
+// Returns the configured origins along with those read from the origins file.
+func (h *host) origins() []string {
+	if h.allOrigins != nil {
+		return h.allOrigins
+	}
+
+	return h.Origins
+}
+
+// Returns the merged policy computed by New, or the rule itself before that.
+func (h *host) policy() *host {
+	if h.effective != nil {
+		return h.effective
+	}
+
+	return h
+}
+
+// UnmarshalJSON also accepts the MaxAge key vulcand stored before the fields had JSON names.
+func (h *host) UnmarshalJSON(data []byte) error {
+	type plain host
+	cfg := struct {
+		*plain
+		LegacyMaxAge int64 `json:"MaxAge"`
+	}{plain: (*plain)(h)}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+
+	if h.MaxAge == 0 {
+		h.MaxAge = cfg.LegacyMaxAge
+	}
+
+	return nil
+}
+
+// defaults struct holds the settings that apply to every rule, and the policy rules can extend.
+type defaults struct {
+	Methods       []string `yaml:"methods,omitempty" json:"methods,omitempty" toml:"methods,omitempty"`
+	Headers       []string `yaml:"headers,omitempty" json:"headers,omitempty" toml:"headers,omitempty"`
+	ExposeHeaders []string `yaml:"expose_headers,omitempty" json:"expose_headers,omitempty" toml:"expose_headers,omitempty"`
+	MaxAge        int64    `yaml:"max_age,omitempty" json:"max_age,omitempty" toml:"max_age,omitempty"`
+	Mode          string   `yaml:"mode,omitempty" json:"mode,omitempty" toml:"mode,omitempty"`
+	Log           string   `yaml:"log,omitempty" json:"log,omitempty" toml:"log,omitempty"`
+
+	// UpstreamHeaders is what becomes of the Access-Control headers set upstream: strip (the default),
+	// merge or upstream.
+	UpstreamHeaders string `yaml:"upstream_headers,omitempty" json:"upstream_headers,omitempty" toml:"upstream_headers,omitempty"`
 }
 
 // Middleware struct holds configuration parameters.
 type Middleware struct {
-	AllowedOrigins map[string]*host
+	Version  int      `yaml:"version" json:"version" toml:"version"`
+	Defaults defaults `yaml:"defaults,omitempty" json:"defaults" toml:"defaults"`
+	Rules    []*host  `yaml:"rules" json:"rules" toml:"rules"`
+
+	// VirtualHosts replace the top level rules for requests to their hosts.
+	VirtualHosts []*vhost `yaml:"virtual_hosts,omitempty" json:"virtual_hosts,omitempty" toml:"virtual_hosts,omitempty"`
+
+	// DenyOrigins are refused before any rule is considered, as are the origins listed in DenyOriginsFile.
+	// The file is read again when it changes.
+	DenyOrigins     []string `yaml:"deny_origins,omitempty" json:"deny_origins,omitempty" toml:"deny_origins,omitempty"`
+	DenyOriginsFile string   `yaml:"deny_origins_file,omitempty" json:"deny_origins_file,omitempty" toml:"deny_origins_file,omitempty"`
+
+	// AllowOriginFunc decides on origins no rule matches, for origins that can't be configured statically.
+	// Its answers are cached for OriginCache.TTL seconds, in a cache holding up to OriginCache.Size of them.
+	AllowOriginFunc func(r *http.Request, origin string) (Policy, bool) `yaml:"-" json:"-" toml:"-"`
+	OriginCache     cacheConfig                                         `yaml:"origin_cache,omitempty" json:"origin_cache,omitempty" toml:"origin_cache,omitempty"`
+
+	// Isolation sets the cross-origin isolation headers of upstream responses, scoped to paths.
+	Isolation []*isolation `yaml:"isolation,omitempty" json:"isolation,omitempty" toml:"isolation,omitempty"`
+
+	// FetchMetadata, when set, refuses cross-site requests using the Sec-Fetch-* headers.
+	FetchMetadata *fetchMetadata `yaml:"fetch_metadata,omitempty" json:"fetch_metadata,omitempty" toml:"fetch_metadata,omitempty"`
+
+	// CSRF, when set, requires state-changing requests to come from the same origin or an allowed one.
+	CSRF *csrf `yaml:"csrf,omitempty" json:"csrf,omitempty" toml:"csrf,omitempty"`
+
+	// MethodOverride, when set, checks the methods tunnelled through override headers against the rules.
+	MethodOverride *methodOverride `yaml:"method_override,omitempty" json:"method_override,omitempty" toml:"method_override,omitempty"`
+
+	// DecisionCache, when set, keeps the decisions made for requests so identical ones, such as repeated
+	// preflights, are answered without running the rules again.
+	DecisionCache *cacheConfig `yaml:"decision_cache,omitempty" json:"decision_cache,omitempty" toml:"decision_cache,omitempty"`
+
+	// Delegate asks a policy service about the requests no rule or AllowOriginFunc allows.
+	Delegate *delegate `yaml:"delegate,omitempty" json:"delegate,omitempty" toml:"delegate,omitempty"`
+
+	// AllowedOrigins holds the bare origin map used before the schema was versioned.
+	// New upgrades it into Rules.
+	AllowedOrigins map[string]*host `yaml:"-" json:",omitempty" toml:"-"`
+
+	// Compiled regex origin patterns, keyed by their configured form.
+	patterns map[string]*regexp.Regexp
+
+	// The compiled origins of the top level rules.
+	matcher *originMatcher
+
+	// The compiled deny list, shared by every handler of the middleware.
+	denied *denyList
+
+	// The answers of AllowOriginFunc, keyed by request host and origin.
+	dynamic *lru
+
+	// The decisions made for requests, keyed by decisionKey.
+	decisions *lru
+
+	// The headers some rule requires, whose presence decisionKey records.
+	required []string
+
+	// The headers some rule constrains the values of, which decisionKey records.
+	constrained []string
 }
 
 // NewHandler initializes a new handler from the middleware config and adds it to the middleware chain.
+// AllowOriginFunc may be set after New, so its cache is created here if need be.
 func (m *Middleware) NewHandler(next http.Handler) (http.Handler, error) {
+	if m.AllowOriginFunc != nil && m.dynamic == nil {
+		m.dynamic = newLRU(m.OriginCache)
+	}
+
 	return &Handler{next: next, cfg: *m}, nil
 }
 
 // String() will be called by loggers inside Vulcand and command line tool.
 func (m *Middleware) String() string {
-	return fmt.Sprintf("origins=%v", m.AllowedOrigins)
+	var origins []string
+	for _, rule := range m.Rules {
+		origins = append(origins, rule.Origins...)
+	}
+
+	var hosts []string
+	for _, vh := range m.VirtualHosts {
+		hosts = append(hosts, vh.String())
+	}
+
+	return fmt.Sprintf("version=%v, mode=%v, origins=%v, virtual_hosts=%v", m.Version, m.Defaults.Mode, origins, hosts)
 }
 
-// Validates that the given origin is allowed.
-func (m *Middleware) isOriginAllowed(origin string) bool {
+// Finds the rule for the given origin, request host and path, preferring an exact match, then a regex
+// or glob pattern, then "*". Only the rules of the virtual host scoped to the path are considered, see
+// rulesForHost and originMatcher, and rules excepting the origin are skipped.
+// Returns the configured origin that matched along with its rule.
+func (m *Middleware) matchOrigin(origin string, requestHost string, path string) (string, *host) {
 	if origin == "" {
-		return false
-	} else if m.AllowedOrigins[allToken] != nil {
-		return true
-	} else if m.AllowedOrigins[origin] != nil {
-		return true
-	} else if m.originMatchesRegex(origin) {
-		return true
+		return "", nil
 	}
 
-	return false
-}
+	vh, rules := m.rulesForHost(requestHost)
+	matcher := m.matcher
+	if vh != nil {
+		matcher = vh.matcher
+	}
 
-func (m *Middleware) originMatchesRegex(origin string) bool {
-	re, err := regexp.Compile("^/(.+)/$")
-	if err != nil {
-		return false
+	if matcher == nil {
+		matcher, _ = newOriginMatcher(rules)
 	}
 
-	for k := range m.AllowedOrigins {
-		if re.MatchString(k) {
-			url := fmt.Sprintf("^%s$", re.FindStringSubmatch(k)[1])
-			match, _ := regexp.MatchString(url, origin)
+	return matcher.match(m, origin, path)
+}
+
+// Finds the deny rule of the request host matching the origin on the given path, if any.
+func (m *Middleware) deniedBy(origin string, requestHost string, path string) (string, *host) {
+	_, rules := m.rulesForHost(requestHost)
+	for _, rule := range rules {
+		if !rule.Deny || m.originExcepted(rule, origin) {
+			continue
+		}
+
+		if _, specificity := bestPath(rule.Paths, path); len(rule.Paths) > 0 && specificity < 0 {
+			continue
+		}
 
-			if match {
-				m.AllowedOrigins[origin] = m.AllowedOrigins[k]
-				return true
+		for _, o := range rule.origins() {
+			if m.originMatches(o, origin) {
+				return o, rule
 			}
 		}
 	}
 
+	return "", nil
+}
+
+// Checks whether the rule excepts the origin.
+func (m *Middleware) originExcepted(rule *host, origin string) bool {
+	for _, o := range rule.ExceptOrigins {
+		if m.originMatches(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks the origin against a configured origin: exact, "*", a regex (e.g. /http://[a-z]+\.skookum\.com/)
+// or a glob (e.g. http://*.skookum.com).
+func (m *Middleware) originMatches(pattern string, origin string) bool {
+	if pattern == origin || pattern == allToken {
+		return true
+	} else if re := m.patterns[pattern]; re != nil {
+		return re.MatchString(origin)
+	} else if strings.ContainsAny(pattern, globCharacters) {
+		match, _ := path.Match(pattern, origin)
+		return match
+	}
+
 	return false
 }
 
+// Describes why the given origin matched the configured origin.
+func (m *Middleware) describeMatch(rule string, origin string) string {
+	switch rule {
+	case origin:
+		return fmt.Sprintf("origin %q is configured explicitly", origin)
+	case allToken:
+		return fmt.Sprintf("%q allows every origin", allToken)
+	case originFuncRule:
+		return fmt.Sprintf("origin %q is allowed by AllowOriginFunc", origin)
+	case delegateRule:
+		return fmt.Sprintf("origin %q is allowed by the policy service", origin)
+	case delegateFailedRule:
+		return "the policy service failed and is configured to fail open"
+	}
+
+	return fmt.Sprintf("origin %q matches pattern %v", origin, rule)
+}
+
 // Return max age value
-func (m *Middleware) maxAgeForOrigin(origin string) int64 {
+func (m *Middleware) maxAgeForOrigin(origin string, requestHost string, path string) int64 {
+	_, hostCfg := m.matchOrigin(origin, requestHost, path)
+	return m.maxAge(hostCfg)
+}
 
-	hostCfg := m.AllowedOrigins[origin]
-	if hostCfg == nil || hostCfg.MaxAge == 0 {
-		return 86400
+// Return max age value of the rule, or the default one
+func (m *Middleware) maxAge(hostCfg *host) int64 {
+	if hostCfg != nil && hostCfg.MaxAge != 0 {
+		return hostCfg.MaxAge
+	} else if m.Defaults.MaxAge != 0 {
+		return m.Defaults.MaxAge
 	}
-	return hostCfg.MaxAge
+
+	return 86400
 }
 
 // Validates that the given method is allowed.
-func (m *Middleware) isMethodAllowed(method string, origin string) bool {
+func (m *Middleware) isMethodAllowed(method string, cfg *host) bool {
 	if method == "" {
 		return false
 	}
 
-	if method == optionsMethod {
-		return true
+	if stringInSlice(method, cfg.ExceptMethods) {
+		return false
 	}
 
-	allowedOrigin := m.findOrigin(origin)
-	if allowedOrigin == nil {
-		return false
+	if method == optionsMethod {
+		return true
 	}
 
-	for _, m := range allowedOrigin.Methods {
+	for _, m := range cfg.Methods {
 		if m == allToken || m == method {
 			return true
 		}
@@ -100,36 +330,25 @@ func (m *Middleware) isMethodAllowed(method string, origin string) bool {
 }
 
 // Validates that ALL of the given headers are allowed.
-func (m *Middleware) areHeadersAllowed(headers []string, origin string) bool {
+func (m *Middleware) areHeadersAllowed(headers []string, cfg *host) bool {
 	if len(headers) == 0 {
 		return true
 	}
 
-	allowedOrigin := m.findOrigin(origin)
-	if allowedOrigin == nil {
-		return false
-	}
+	for _, h := range headers {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
 
-	if stringInSlice(allToken, allowedOrigin.Headers) {
-		return true
-	}
+		if headerMatches(h, cfg.ExceptHeaders) {
+			return false
+		}
 
-	for _, h := range headers {
-		h = http.CanonicalHeaderKey(h)
-		if h != "" && !stringInSlice(h, allowedOrigin.Headers) {
+		if !stringInSlice(allToken, cfg.Headers) && !headerMatches(h, cfg.Headers) {
 			return false
 		}
 	}
 
 	return true
 }
-
-// Looks for the given origin or "*" if present.
-func (m *Middleware) findOrigin(origin string) *host {
-	allowedOrigin := m.AllowedOrigins[origin]
-	if allowedOrigin == nil {
-		allowedOrigin = m.AllowedOrigins[allToken]
-	}
-
-	return allowedOrigin
-}
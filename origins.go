@@ -0,0 +1,150 @@
+package cors
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// originList matches origins against exact origins, globs and regex patterns.
+type originList struct {
+	exact    map[string]bool
+	globs    []string
+	patterns []*regexp.Regexp
+}
+
+// Compiles the given origins into a list, failing on broken patterns.
+func newOriginList(origins []string) (*originList, error) {
+	list := &originList{exact: map[string]bool{}}
+	for _, origin := range origins {
+		if match := patternSyntax.FindStringSubmatch(origin); match != nil {
+			re, err := regexp.Compile(fmt.Sprintf("^%s$", match[1]))
+			if err != nil {
+				return nil, fmt.Errorf("%s %v: %v", errorConfigPattern, origin, err)
+			}
+
+			list.patterns = append(list.patterns, re)
+		} else if strings.ContainsAny(origin, globCharacters) {
+			if _, err := path.Match(origin, ""); err != nil {
+				return nil, fmt.Errorf("%s %v: %v", errorConfigPattern, origin, err)
+			}
+
+			list.globs = append(list.globs, origin)
+		} else {
+			list.exact[origin] = true
+		}
+	}
+
+	return list, nil
+}
+
+// Checks whether the origin is on the list.
+func (l *originList) matches(origin string) bool {
+	if l == nil {
+		return false
+	} else if l.exact[origin] {
+		return true
+	}
+
+	for _, glob := range l.globs {
+		if match, _ := path.Match(glob, origin); match {
+			return true
+		}
+	}
+
+	for _, re := range l.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads the origins of a file, or of every file in a directory.
+func loadOrigins(name string) ([]string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errorFileIO, err)
+	} else if !info.IsDir() {
+		return readOriginsFile(name)
+	}
+
+	files, err := ioutil.ReadDir(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+
+	var origins []string
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		loaded, err := readOriginsFile(filepath.Join(name, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		origins = append(origins, loaded...)
+	}
+
+	return origins, nil
+}
+
+// Reads a file of origins, one per line. Blank lines and lines starting with # are skipped.
+// In a .csv file the origin is the first column, and a header row is skipped.
+func readOriginsFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errorFileIO, err)
+	}
+	defer f.Close()
+
+	var origins []string
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		r := csv.NewReader(f)
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", errorFileIO, err)
+		}
+
+		for i, record := range records {
+			origin := strings.TrimSpace(record[0])
+			if origin == "" || i == 0 && !strings.Contains(origin, "://") && !patternSyntax.MatchString(origin) {
+				continue
+			}
+
+			origins = append(origins, normalizeOrigin(origin))
+		}
+
+		return origins, nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			origins = append(origins, normalizeOrigin(line))
+		}
+	}
+
+	return origins, scanner.Err()
+}
+
+// Lower cases an origin and drops trailing slashes, as browsers send it. Regex patterns are left alone.
+func normalizeOrigin(origin string) string {
+	if patternSyntax.MatchString(origin) {
+		return origin
+	}
+
+	return strings.ToLower(strings.TrimRight(origin, "/"))
+}
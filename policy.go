@@ -0,0 +1,65 @@
+package cors
+
+import "net/http"
+
+// Policy is what an origin allowed by AllowOriginFunc may do.
+type Policy struct {
+	Methods       []string
+	Headers       []string
+	ExposeHeaders []string
+	Credentials   bool
+	MaxAge        int64
+
+	TimingAllowOrigin   []string
+	AllowPrivateNetwork bool
+}
+
+// Turns the policy into a rule for the origin.
+func (p Policy) rule(origin string) *host {
+	return &host{
+		Origins:       []string{origin},
+		Methods:       upperMethods(p.Methods),
+		Headers:       canonicalHeaders(p.Headers),
+		ExposeHeaders: canonicalHeaders(p.ExposeHeaders),
+		Credentials:   p.Credentials,
+		MaxAge:        p.MaxAge,
+
+		TimingAllowOrigin:   p.TimingAllowOrigin,
+		AllowPrivateNetwork: p.AllowPrivateNetwork,
+	}
+}
+
+// Finds the rule for the request's origin. When no configured rule matches, AllowOriginFunc is
+// consulted and its answer cached per origin and request host, then the policy service, if any,
+// is asked about the method and request headers.
+func (m *Middleware) policyFor(r *http.Request, method string, headers string) (string, *host, error) {
+	origin := r.Header.Get(originHeader)
+	rule, cfg := m.matchOrigin(origin, r.Host, r.URL.Path)
+	if cfg != nil || origin == "" {
+		return rule, cfg, nil
+	}
+
+	if m.AllowOriginFunc != nil {
+		key := hostname(r.Host) + " " + origin
+		cached, ok := m.dynamic.get(key)
+		if !ok {
+			if policy, allowed := m.AllowOriginFunc(r, origin); allowed {
+				cached = policy.rule(origin)
+			} else {
+				cached = (*host)(nil)
+			}
+
+			m.dynamic.add(key, cached)
+		}
+
+		if cfg := cached.(*host); cfg != nil {
+			return originFuncRule, cfg, nil
+		}
+	}
+
+	if m.Delegate != nil {
+		return m.Delegate.decide(r, method, headers)
+	}
+
+	return "", nil, nil
+}
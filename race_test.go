@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package cors
+
+// Set when the tests run with the race detector.
+const raceEnabled = true
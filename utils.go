@@ -1,5 +1,11 @@
 package cors
 
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
 // Searches for a string in a given slice.
 func stringInSlice(target string, list []string) bool {
 	for _, value := range list {
@@ -10,3 +16,140 @@ func stringInSlice(target string, list []string) bool {
 
 	return false
 }
+
+// Splits comma separated flag values into a single list, dropping empty entries.
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+	}
+
+	return list
+}
+
+// Checks whether a response header is one of the Access-Control headers.
+func isCORSHeader(name string) bool {
+	return len(name) > len(corsHeaderPrefix) && strings.EqualFold(name[:len(corsHeaderPrefix)], corsHeaderPrefix)
+}
+
+// Checks whether an Access-Control header holds a list of tokens.
+func isListHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name == allowMethodsHeader || name == allowHeadersHeader || name == exposeHeader
+}
+
+// Joins comma separated header values into one, dropping duplicates regardless of case.
+func mergeTokens(values []string) string {
+	var tokens []string
+	for _, t := range splitList(values) {
+		if !headerMatches(t, tokens) {
+			tokens = append(tokens, t)
+		}
+	}
+
+	return strings.Join(tokens, ", ")
+}
+
+// Checks a header name against allowed names and prefix patterns such as "X-Client-*", ignoring case.
+func headerMatches(name string, allowed []string) bool {
+	for _, a := range allowed {
+		if isHeaderPattern(a) {
+			prefix := strings.TrimSuffix(a, allToken)
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks whether a header entry is a prefix pattern such as "X-Client-*".
+func isHeaderPattern(entry string) bool {
+	return len(entry) > len(allToken) && strings.HasSuffix(entry, allToken)
+}
+
+// Returns the canonical form of the given header names.
+func canonicalHeaders(headers []string) []string {
+	var canonical []string
+	for _, h := range headers {
+		canonical = append(canonical, http.CanonicalHeaderKey(h))
+	}
+
+	return canonical
+}
+
+// Returns the given methods in upper case, as requests send them.
+func upperMethods(methods []string) []string {
+	var upper []string
+	for _, m := range methods {
+		upper = append(upper, strings.ToUpper(m))
+	}
+
+	return upper
+}
+
+// Returns the values found in either list, without duplicates.
+func union(list []string, other []string) []string {
+	var merged []string
+	for _, value := range append(append([]string{}, list...), other...) {
+		if !stringInSlice(value, merged) {
+			merged = append(merged, value)
+		}
+	}
+
+	return merged
+}
+
+// Returns the values of the list that are not in the excluded list.
+func without(list []string, excluded []string) []string {
+	var remaining []string
+	for _, value := range list {
+		if !stringInSlice(value, excluded) {
+			remaining = append(remaining, value)
+		}
+	}
+
+	return remaining
+}
+
+// Finds the most specific of the path entries matching the given path, with its specificity.
+// The specificity is the number of characters in the entry that aren't wildcards, or -1 when nothing matches.
+func bestPath(entries []string, p string) (string, int) {
+	best, specificity := "", -1
+	for _, entry := range entries {
+		if !pathMatches(entry, p) {
+			continue
+		}
+
+		n := len(entry) - strings.Count(entry, "*") - strings.Count(entry, "?")
+		if n > specificity {
+			best, specificity = entry, n
+		}
+	}
+
+	return best, specificity
+}
+
+// Checks the path against an entry: a prefix ending in "*", a glob, or a path and everything below it.
+func pathMatches(entry string, p string) bool {
+	prefix := strings.TrimSuffix(entry, allToken)
+	if prefix != entry && !strings.ContainsAny(prefix, globCharacters) {
+		return strings.HasPrefix(p, prefix)
+	}
+
+	if strings.ContainsAny(entry, globCharacters) {
+		match, _ := path.Match(entry, p)
+		return match
+	}
+
+	dir := strings.TrimSuffix(entry, "/")
+	return p == entry || strings.HasPrefix(p, dir) && len(p) > len(dir) && p[len(dir)] == '/'
+
+}
@@ -0,0 +1,74 @@
+package cors
+
+import (
+	"net"
+	"strings"
+)
+
+// vhost struct represents the rules applied to requests for a set of hosts.
+type vhost struct {
+	Name  string   `yaml:"name,omitempty" json:"name,omitempty" toml:"name,omitempty"`
+	Hosts []string `yaml:"hosts" json:"hosts" toml:"hosts"`
+	Rules []*host  `yaml:"rules" json:"rules" toml:"rules"`
+
+	// The compiled origins of the rules.
+	matcher *originMatcher
+}
+
+// Returns the name of the virtual host, falling back to its first host.
+func (vh *vhost) String() string {
+	if vh.Name != "" || len(vh.Hosts) == 0 {
+		return vh.Name
+	}
+
+	return vh.Hosts[0]
+}
+
+// Finds the virtual host for the request host, preferring an exact host over the longest wildcard.
+// Returns the top level rules when no virtual host matches.
+func (m *Middleware) rulesForHost(requestHost string) (*vhost, []*host) {
+	name := hostname(requestHost)
+
+	var wildcard *vhost
+	longest := 0
+	for _, vh := range m.VirtualHosts {
+		for _, h := range vh.Hosts {
+			if h == name {
+				return vh, vh.Rules
+			}
+
+			if strings.HasPrefix(h, "*.") && strings.HasSuffix(name, h[1:]) && len(h) > longest {
+				wildcard, longest = vh, len(h)
+			}
+		}
+	}
+
+	if wildcard != nil {
+		return wildcard, wildcard.Rules
+	}
+
+	return nil, m.Rules
+}
+
+// Returns the top level rules followed by the rules of every virtual host.
+func (m *Middleware) allRules() []*host {
+	rules := append([]*host{}, m.Rules...)
+	for _, vh := range m.VirtualHosts {
+		rules = append(rules, vh.Rules...)
+	}
+
+	return rules
+}
+
+// Returns the lower cased request host without its port.
+func hostname(requestHost string) string {
+	if strings.LastIndexByte(requestHost, ':') <= strings.LastIndexByte(requestHost, ']') {
+		return strings.ToLower(requestHost)
+	}
+
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+
+	return strings.ToLower(requestHost)
+}
@@ -0,0 +1,35 @@
+package cors
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Checks whether the request is a WebSocket handshake.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get(upgradeHeader), websocketToken) {
+		return false
+	}
+
+	for _, token := range strings.Split(r.Header.Get(connectionHeader), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks the origin of a WebSocket handshake, which browsers don't apply CORS to. Same-origin handshakes
+// are allowed, others need a rule allowing the origin that doesn't turn WebSockets off.
+func (h *Handler) handleWebSocket(d *Decision, r *http.Request) {
+	if d.Origin == requestOrigin(r) {
+		d.Match = "handshake is same-origin"
+		return
+	}
+
+	cfg := h.matchRule(d, r, r.Method, "")
+	if cfg != nil && cfg.WebSocket != nil && !*cfg.WebSocket {
+		d.deny(errorWebSocket)
+	}
+}
@@ -0,0 +1,173 @@
+package cors
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// responseWriter wraps the upstream response to finish the CORS headers once the upstream
+// headers are known, just before they are written.
+type responseWriter struct {
+	http.ResponseWriter
+	exposePatterns []string
+	wroteHeader    bool
+
+	// The Access-Control headers decided on, and what becomes of those set upstream.
+	cors     http.Header
+	upstream string
+
+	// The cross-origin isolation headers, and whether they replace the values set upstream.
+	isolation         http.Header
+	overrideIsolation bool
+}
+
+// WriteHeader finishes the CORS headers before writing the status code.
+func (w *responseWriter) WriteHeader(code int) {
+	w.finish()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Finishes the CORS headers unless they already are. The handler calls it once the upstream returns,
+// for upstreams that set headers without writing anything.
+func (w *responseWriter) finish() {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	w.setCORSHeaders()
+	w.exposeMatching()
+	w.isolate()
+}
+
+// Write finishes the CORS headers before the first write.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends buffered data to the client if the upstream response supports it.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the upstream take over the connection if the upstream response supports it.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New(errorHijack)
+	}
+
+	w.wroteHeader = true
+	return h.Hijack()
+}
+
+// CloseNotify reports when the client goes away if the upstream response supports it.
+func (w *responseWriter) CloseNotify() <-chan bool {
+	if n, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return n.CloseNotify()
+	}
+
+	return make(chan bool)
+}
+
+// Unwrap returns the upstream response, for http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Settles the Access-Control headers the upstream changed. Those are stripped by default, or kept
+// when the upstream wins. Merging keeps those we don't set and joins list headers, ours winning otherwise.
+func (w *responseWriter) setCORSHeaders() {
+	header := w.Header()
+	for name, values := range header {
+		if !isCORSHeader(name) {
+			continue
+		}
+
+		ours, set := w.cors[name]
+		if set && hasValues(values, ours) {
+			if len(values) == len(ours) {
+				continue
+			}
+
+			values = values[len(ours):]
+		}
+
+		switch {
+		case w.upstream == upstreamWins, w.upstream == upstreamMerge && !set:
+			header[name] = values
+		case w.upstream == upstreamMerge && isListHeader(name):
+			header[name] = []string{mergeTokens(append(append([]string{}, ours...), values...))}
+		default:
+			delete(header, name)
+		}
+	}
+
+	for name, values := range w.cors {
+		if _, ok := header[name]; !ok {
+			header[name] = append([]string{}, values...)
+		}
+	}
+}
+
+// Checks whether the header values start with the given ones.
+func hasValues(values []string, prefix []string) bool {
+	if len(values) < len(prefix) {
+		return false
+	}
+
+	for i, v := range prefix {
+		if values[i] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sets the cross-origin isolation headers, keeping the upstream values unless they are overridden.
+func (w *responseWriter) isolate() {
+	header := w.Header()
+	for name, values := range w.isolation {
+		if w.overrideIsolation || header.Get(name) == "" {
+			header[name] = values
+		}
+	}
+}
+
+// Adds the upstream headers matching the expose patterns to Access-Control-Expose-Headers.
+func (w *responseWriter) exposeMatching() {
+	if len(w.exposePatterns) == 0 {
+		return
+	}
+
+	header := w.Header()
+
+	var exposed []string
+	if v := header.Get(exposeHeader); v != "" {
+		exposed = strings.Split(v, ", ")
+	}
+
+	for name := range header {
+		if !headerMatches(name, exposed) && headerMatches(name, w.exposePatterns) {
+			exposed = append(exposed, name)
+		}
+	}
+
+	if len(exposed) > 0 {
+		header.Set(exposeHeader, strings.Join(exposed, ", "))
+	}
+}